@@ -0,0 +1,136 @@
+package qws
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/amh11706/qws/lock"
+	"github.com/gorilla/websocket"
+)
+
+// LoginFrame is the first message a client sends after the upgrade, encoded
+// with the negotiated codec. It is bounded by MaxHandshakeSize.
+type LoginFrame struct {
+	Token   string `json:"token"`
+	Version string `json:"version"`
+	// Resume and Seq are sent by a client coming back from a dropped socket,
+	// see SessionStore.Resume.
+	Resume string `json:"resume,omitempty"`
+	Seq    uint32 `json:"seq,omitempty"`
+	// Chunks asks for large messages as Chunk messages instead of HTTP
+	// fetches.
+	Chunks bool `json:"chunks,omitempty"`
+}
+
+// Authenticator turns a login frame into the user it belongs to. Errors that
+// are not a *CloseReason are reported to the client as ErrLoginFailed.
+type Authenticator interface {
+	Authenticate(ctx context.Context, login *LoginFrame) (*User, error)
+}
+
+// CloseReason is a refused handshake. It is sent to the client in the close
+// frame so the client can tell a bad token from an outdated build.
+type CloseReason struct {
+	Code   int
+	Reason string
+}
+
+func (r *CloseReason) Error() string {
+	return r.Reason
+}
+
+// Close codes 4000-4999 are reserved for applications by RFC 6455.
+var (
+	ErrLoginFailed   = &CloseReason{Code: 4000, Reason: "Login failed."}
+	ErrBadToken      = &CloseReason{Code: 4001, Reason: "Your login has expired. Please log in again."}
+	ErrLocked        = &CloseReason{Code: 4002, Reason: "This account has been locked."}
+	ErrClientVersion = &CloseReason{Code: 4003, Reason: "A new version is available. Please refresh the page."}
+	ErrResumeFailed  = &CloseReason{Code: 4004, Reason: "Your session could not be resumed. Please log in again."}
+	ErrBadLoginFrame = &CloseReason{Code: websocket.CloseUnsupportedData, Reason: "Invalid login message."}
+)
+
+// NewGuest makes a guest user. Each guest gets its own User, so guests never
+// share a chat budget or a lock.
+func NewGuest() *User {
+	return &User{Name: "Guest", Blocked: make(map[string]struct{}), Lock: lock.NewLock()}
+}
+
+// SQLAuthenticator looks the login token up in the users table.
+type SQLAuthenticator struct {
+	// AllowGuests lets a login without a token in as a guest.
+	AllowGuests bool
+}
+
+func (a SQLAuthenticator) Authenticate(ctx context.Context, login *LoginFrame) (*User, error) {
+	if login.Token == "" {
+		if a.AllowGuests {
+			return NewGuest(), nil
+		}
+		return nil, ErrBadToken
+	}
+	u := &User{}
+	err := Users.GetOptions(ctx, u, "WHERE token=?", "id,username,decoration,admin_level,locked,inventory", login.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBadToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Locked {
+		return nil, ErrLocked
+	}
+	u.Blocked = make(map[string]struct{})
+	u.Lock = lock.NewLock()
+	return u, nil
+}
+
+// MemoryAuthenticator accepts tokens added to it at runtime. It suits tests
+// and tools that have no database.
+type MemoryAuthenticator struct {
+	AllowGuests bool
+	lock        sync.Mutex
+	users       map[string]*User
+}
+
+func NewMemoryAuthenticator() *MemoryAuthenticator {
+	return &MemoryAuthenticator{users: make(map[string]*User)}
+}
+
+func (a *MemoryAuthenticator) Add(token string, u *User) {
+	if u.Lock == nil {
+		u.Lock = lock.NewLock()
+	}
+	if u.Blocked == nil {
+		u.Blocked = make(map[string]struct{})
+	}
+	a.lock.Lock()
+	a.users[token] = u
+	a.lock.Unlock()
+}
+
+func (a *MemoryAuthenticator) Remove(token string) {
+	a.lock.Lock()
+	delete(a.users, token)
+	a.lock.Unlock()
+}
+
+func (a *MemoryAuthenticator) Authenticate(ctx context.Context, login *LoginFrame) (*User, error) {
+	if login.Token == "" {
+		if a.AllowGuests {
+			return NewGuest(), nil
+		}
+		return nil, ErrBadToken
+	}
+	a.lock.Lock()
+	u := a.users[login.Token]
+	a.lock.Unlock()
+	if u == nil {
+		return nil, ErrBadToken
+	}
+	if u.Locked {
+		return nil, ErrLocked
+	}
+	return u, nil
+}
@@ -0,0 +1,198 @@
+package qws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/amh11706/logger"
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/lock"
+	"github.com/amh11706/qws/outcmds"
+	"github.com/gorilla/websocket"
+)
+
+// BotHandler receives one message the server sent to a bot.
+type BotHandler func(ctx context.Context, b *BotConn, m *ClientMessage)
+
+// BotConn is a connection for an AI player. It goes through the same outbox,
+// router and close hooks as a client, but the messages written to it are
+// decoded and handed to the handler registered for their command instead of
+// a socket.
+type BotConn struct {
+	*UserConn
+	ctx      context.Context
+	lock     sync.Mutex
+	handlers map[outcmds.Cmd]BotHandler
+	fallback BotHandler
+}
+
+// NewBotConn makes a bot connection with the given session id. Register its
+// handlers, then call Start.
+func NewBotConn(id int64, user *User) *BotConn {
+	if user.Lock == nil {
+		user.Lock = lock.NewLock()
+	}
+	b := &BotConn{handlers: make(map[outcmds.Cmd]BotHandler)}
+	b.UserConn = NewTransportUserConn(user, newBotTransport(b), "")
+	b.SId = id
+	b.bot = true
+	return b
+}
+
+// Start begins delivering messages. Handlers run one at a time on the bot's
+// writer, in the order the messages were written, with ctx as their parent.
+func (b *BotConn) Start(ctx context.Context) {
+	b.lock.Lock()
+	b.ctx = ctx
+	b.lock.Unlock()
+	b.ListenWrite(ctx)
+}
+
+// Handle sets the handler for cmd, replacing any earlier one.
+func (b *BotConn) Handle(cmd outcmds.Cmd, h BotHandler) {
+	b.lock.Lock()
+	b.handlers[cmd] = h
+	b.lock.Unlock()
+}
+
+// HandleOther sets the handler for commands without one of their own.
+func (b *BotConn) HandleOther(h BotHandler) {
+	b.lock.Lock()
+	b.fallback = h
+	b.lock.Unlock()
+}
+
+// Subscribe delivers every message for cmd to the returned channel. A message
+// that does not fit in the buffer is dropped and logged rather than holding
+// up the bot's other messages.
+func (b *BotConn) Subscribe(cmd outcmds.Cmd, buffer int) <-chan *ClientMessage {
+	ch := make(chan *ClientMessage, buffer)
+	b.Handle(cmd, func(ctx context.Context, b *BotConn, m *ClientMessage) {
+		select {
+		case ch <- m:
+		default:
+			logger.Error("Bot", b.PrintName(), "dropped cmd", m.Cmd, "with a full channel")
+		}
+	})
+	return ch
+}
+
+// Inject hands a message to the bot's router as if the bot's client had sent
+// it. It is handled in order with the bot's other injected messages.
+func (b *BotConn) Inject(ctx context.Context, cmd incmds.Cmd, data interface{}) error {
+	m := &RawMessage{Cmd: cmd}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		m.Data = raw
+	}
+	b.dispatch(ctx, m)
+	return nil
+}
+
+// Reply answers a request the server made of the bot with Request.
+func (b *BotConn) Reply(ctx context.Context, id uint32, data interface{}) error {
+	m := &RawMessage{Cmd: incmds.Reply, Id: id}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		m.Data = raw
+	}
+	b.dispatch(ctx, m)
+	return nil
+}
+
+func (b *BotConn) deliver(data []byte) error {
+	m, err := DecodeClientMessage(JSONCodec, data, b.FetchKey())
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	h := b.handlers[m.Cmd]
+	if h == nil {
+		h = b.fallback
+	}
+	ctx := b.ctx
+	b.lock.Unlock()
+	if h != nil {
+		h(ctx, b, m)
+	}
+	return nil
+}
+
+// botTransport is the socket of a BotConn. Writes are delivered to the bot's
+// handlers, and there is never anything to read.
+type botTransport struct {
+	bot       *BotConn
+	lock      sync.Mutex
+	pong      func(string) error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBotTransport(b *BotConn) *botTransport {
+	return &botTransport{bot: b, closed: make(chan struct{})}
+}
+
+var errBotClosed = &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "bot closed"}
+
+func (t *botTransport) ReadMessage() (int, []byte, error) {
+	<-t.closed
+	return 0, nil, errBotClosed
+}
+
+func (t *botTransport) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-t.closed:
+		return websocket.ErrCloseSent
+	default:
+	}
+	return t.bot.deliver(data)
+}
+
+func (t *botTransport) WritePrepared(m *PreparedMessage) error {
+	if m.opaque() {
+		return nil
+	}
+	return t.WriteMessage(m.FrameType(), m.Data())
+}
+
+func (t *botTransport) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		t.lock.Lock()
+		pong := t.pong
+		t.lock.Unlock()
+		if pong != nil {
+			return pong(string(data))
+		}
+		return nil
+	case websocket.CloseMessage:
+		return t.Close()
+	}
+	return errors.New("bot: unsupported control message")
+}
+
+func (t *botTransport) SetPongHandler(h func(appData string) error) {
+	t.lock.Lock()
+	t.pong = h
+	t.lock.Unlock()
+}
+
+func (t *botTransport) SetReadLimit(limit int64) {}
+
+func (t *botTransport) Subprotocol() string {
+	return JSONCodec.Name()
+}
+
+func (t *botTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
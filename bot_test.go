@@ -0,0 +1,66 @@
+package qws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+)
+
+func TestBotConnReceivesBroadcasts(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	turns := b.Subscribe(outcmds.Turn, 1)
+	b.Start(t.Context())
+	defer b.Close()
+
+	UserList[UserConner]{b.Id(): b}.Broadcast(t.Context(), outcmds.Turn, map[string]int{"turn": 4})
+	select {
+	case m := <-turns:
+		var turn struct{ Turn int }
+		if err := json.Unmarshal(m.Data, &turn); err != nil || turn.Turn != 4 {
+			t.Fatalf("bot got %s, %v", m.Data, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("bot did not receive the broadcast")
+	}
+	if !b.IsBot() {
+		t.Fatal("BotConn does not report itself as a bot")
+	}
+}
+
+func TestBotConnInjectAndClose(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	b.Start(t.Context())
+
+	ready := make(chan string, 1)
+	HandleDynamic(b.Router(), incmds.Ready, func(ctx context.Context, c UserConner, in string) string {
+		ready <- in
+		return ""
+	})
+	closed := make(chan struct{})
+	b.AddCloseHook(t.Context(), NewCloseHandler(func(ctx context.Context, c *UserConn) {
+		close(closed)
+	}))
+
+	if err := b.Inject(t.Context(), incmds.Ready, "yes"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case in := <-ready:
+		if in != "yes" {
+			t.Fatalf("router got %q", in)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("injected message was not routed")
+	}
+
+	b.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close hooks did not run")
+	}
+}
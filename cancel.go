@@ -0,0 +1,124 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+// ErrNotRequest is returned by SendPartial outside the handling of a
+// message with an Id.
+var ErrNotRequest = errors.New("qws: not handling a request")
+
+// runningRequest is a message with an Id from the moment it is queued until
+// its handler returns.
+type runningRequest struct {
+	id        uint32
+	conn      *UserConn
+	cancelled atomic.Bool
+	lock      sync.Mutex
+	cancel    context.CancelFunc
+}
+
+// running holds a connection's requests by Id, so the client can cancel
+// them.
+type running struct {
+	lock sync.Mutex
+	byId map[uint32]*runningRequest
+}
+
+// add records m as running, unless a request with its Id already is.
+func (r *running) add(c *UserConn, m *RawMessage) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.byId[m.Id] != nil {
+		return
+	}
+	if r.byId == nil {
+		r.byId = make(map[uint32]*runningRequest)
+	}
+	m.req = &runningRequest{id: m.Id, conn: c}
+	r.byId[m.Id] = m.req
+}
+
+func (r *running) remove(req *runningRequest) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.byId[req.id] == req {
+		delete(r.byId, req.id)
+	}
+}
+
+func (r *running) cancel(id uint32) bool {
+	r.lock.Lock()
+	req := r.byId[id]
+	r.lock.Unlock()
+	if req == nil {
+		return false
+	}
+	req.cancelled.Store(true)
+	req.lock.Lock()
+	cancel := req.cancel
+	req.lock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return true
+}
+
+type runningRequestKey struct{}
+
+// start gives req's handler a context the client can cancel. It reports
+// false if the client already has.
+func (req *runningRequest) start(ctx context.Context) (context.Context, context.CancelFunc, bool) {
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, runningRequestKey{}, req))
+	req.lock.Lock()
+	req.cancel = cancel
+	req.lock.Unlock()
+	if req.cancelled.Load() {
+		cancel()
+		return ctx, cancel, false
+	}
+	return ctx, cancel, true
+}
+
+// handleCancel cancels the request m names with its Id. Like replies, it
+// skips the ordered queue, since the request it cancels may be holding the
+// queue up.
+func (c *UserConn) handleCancel(m *RawMessage) bool {
+	if m.Cmd != incmds.Cancel {
+		return false
+	}
+	if !c.running.cancel(m.Id) {
+		log.Printf("\x1b[36m%s\x1b[0m cancelled unknown request %d\n", c.PrintName(), m.Id)
+	}
+	return true
+}
+
+// suppressed reports whether m answers a request in ctx that the client
+// cancelled, and so should not be sent. Requests the handler makes with
+// UserConn.Request have a Cmd and are never suppressed.
+func suppressed(ctx context.Context, m *Message) bool {
+	req, _ := ctx.Value(runningRequestKey{}).(*runningRequest)
+	return req != nil && m.Cmd == 0 && req.id == m.Id && req.cancelled.Load()
+}
+
+// SendPartial sends data as one partial result of the request being handled
+// in ctx. The client gets any number of them with More set, before the final
+// reply the handler returns or sends as usual. It returns the context's error
+// once the client cancels the request.
+func SendPartial(ctx context.Context, data interface{}) error {
+	req, _ := ctx.Value(runningRequestKey{}).(*runningRequest)
+	if req == nil {
+		return ErrNotRequest
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	req.conn.SendRaw(ctx, &Message{Id: req.id, Data: data, More: true})
+	return nil
+}
@@ -0,0 +1,323 @@
+package qws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amh11706/logger"
+	"github.com/amh11706/qws/incmds"
+	"github.com/google/uuid"
+)
+
+// Messages over MaxJsonSize reach a client one of two ways. By default they
+// are offloaded and the client fetches them over HTTP. Clients that log in
+// with LoginFrame.Chunks get them split into Chunk messages instead, which
+// are queued behind game traffic so a large reply does not hold up the
+// frames after it.
+
+// ChunkSize is how much of a large message one outbound chunk carries.
+var ChunkSize = 32 * 1024
+
+// Chunk is one part of a message that was split for being large. Data is a
+// slice of the whole message as its codec encoded it, so the reassembled
+// bytes decode like any other frame.
+type Chunk struct {
+	Stream uint32 `json:"stream"`
+	// Seq counts from 0 to Total-1. An inbound chunk with a negative Seq
+	// only asks which chunks of Stream are missing.
+	Seq   int    `json:"seq"`
+	Total int    `json:"total"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// ChunkStatus replies to an inbound chunk sent with an Id, so a client that
+// lost its socket mid upload can resend only what is missing.
+type ChunkStatus struct {
+	Stream  uint32 `json:"stream"`
+	Missing []int  `json:"missing"`
+}
+
+var errChunk = errors.New("invalid chunk")
+
+// nextChunkStream numbers outbound chunked messages across every connection.
+var nextChunkStream atomic.Uint32
+
+// largeMessage is the full encoding of a message over MaxJsonSize. It is
+// only offloaded, or split into chunks, once a recipient needs it that way.
+type largeMessage struct {
+	codec Codec
+	full  []byte
+
+	lock    sync.Mutex
+	held    bool
+	offload uuid.UUID
+	stub    []byte
+	err     error
+
+	chunkOnce sync.Once
+	chunks    []*PreparedMessage
+	chunkErr  error
+}
+
+// offloaded stores the message and returns its id, the first time for every
+// recipient that fetches it over HTTP.
+func (l *largeMessage) offloaded() (uuid.UUID, []byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.offload == uuid.Nil && l.err == nil {
+		l.offload, l.err = Offloads.Add(l.full, offloadContentType(l.codec))
+		if l.err != nil {
+			return uuid.Nil, nil, l.err
+		}
+		if l.held {
+			Offloads.Hold(l.offload)
+		}
+		l.stub, l.err = l.codec.Marshal(map[string]string{"httpid": l.offload.String()})
+	}
+	return l.offload, l.stub, l.err
+}
+
+// hold keeps the offloaded message until release, see OffloadStore.Hold.
+func (l *largeMessage) hold() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.held = true
+}
+
+func (l *largeMessage) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.held && l.offload != uuid.Nil {
+		Offloads.Release(l.offload)
+	}
+	l.held = false
+}
+
+func (l *largeMessage) chunked() ([]*PreparedMessage, error) {
+	l.chunkOnce.Do(func() {
+		stream := nextChunkStream.Add(1)
+		total := (len(l.full) + ChunkSize - 1) / ChunkSize
+		for seq := 0; seq < total; seq++ {
+			part := l.full[seq*ChunkSize : min((seq+1)*ChunkSize, len(l.full))]
+			b, err := l.codec.Marshal(&Message{Cmd: ChunkCmd.Cmd, Data: &Chunk{Stream: stream, Seq: seq, Total: total, Data: part}})
+			if err != nil {
+				l.chunkErr = err
+				return
+			}
+			l.chunks = append(l.chunks, NewPreparedMessage(l.codec.FrameType(), b))
+		}
+	})
+	return l.chunks, l.chunkErr
+}
+
+// SetChunked makes large messages reach this connection as Chunk messages
+// rather than through HTTP.
+func (c *Conn) SetChunked(chunked bool) {
+	c.chunked.Store(chunked)
+}
+
+// sendLarge prepares f, which carries a large message, the way this
+// connection takes them. It reports whether f itself should be queued, which
+// is not the case when its chunks were queued instead.
+func (c *Conn) sendLarge(f *Frame) bool {
+	l := f.Message.large
+	if c.chunked.Load() {
+		chunks, err := l.chunked()
+		if logger.Check(err) {
+			return false
+		}
+		prio := max(f.Priority, PriorityList)
+		for _, m := range chunks {
+			if !c.push(&Frame{Message: m, Priority: prio, NoDrop: true}) {
+				break
+			}
+		}
+		return false
+	}
+	id, _, err := l.offloaded()
+	if logger.Check(err) {
+		return false
+	}
+	Offloads.Grant(id, c.fetchKey)
+	return true
+}
+
+// ChunkAssembler puts chunked messages back together. The zero value is
+// ready to use.
+type ChunkAssembler struct {
+	// MaxSize bounds a reassembled message. Zero means MaxMessageSize.
+	MaxSize int
+	// MaxStreams bounds how many messages are assembled at once. The one
+	// that has waited longest for a chunk is dropped to make room. Zero
+	// means 4.
+	MaxStreams int
+	// Idle drops a message that has not had a chunk for this long. Zero
+	// means a minute.
+	Idle time.Duration
+
+	lock    sync.Mutex
+	streams map[uint32]*chunkStream
+}
+
+// A stream's Total is bounded by how many chunks of at least minChunkSize
+// its MaxSize holds, but never below minChunks, so a client cannot make the
+// assembler allocate for millions of chunks with one small frame.
+const (
+	minChunkSize = 1024
+	minChunks    = 16
+)
+
+// limits returns the largest message and the most chunks a stream may have.
+func (a *ChunkAssembler) limits() (int, int) {
+	maxSize := a.MaxSize
+	if maxSize <= 0 {
+		maxSize = MaxMessageSize
+	}
+	return maxSize, max(minChunks, (maxSize+minChunkSize-1)/minChunkSize)
+}
+
+type chunkStream struct {
+	parts [][]byte
+	got   int
+	size  int
+	last  time.Time
+}
+
+// Add stores ch and returns the whole message once its last chunk arrives.
+// Chunks that were already received are ignored.
+func (a *ChunkAssembler) Add(ch *Chunk) ([]byte, error) {
+	maxSize, maxChunks := a.limits()
+	if ch.Total <= 0 || ch.Seq >= ch.Total || ch.Total > maxChunks {
+		return nil, fmt.Errorf("%w: seq %d of %d", errChunk, ch.Seq, ch.Total)
+	}
+	if ch.Seq < 0 {
+		return nil, nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	a.sweep(now)
+	s := a.streams[ch.Stream]
+	if s == nil {
+		a.makeRoom()
+		s = &chunkStream{parts: make([][]byte, ch.Total)}
+		a.streams[ch.Stream] = s
+	} else if len(s.parts) != ch.Total {
+		return nil, fmt.Errorf("%w: stream %d changed its total", errChunk, ch.Stream)
+	}
+	s.last = now
+	if s.parts[ch.Seq] != nil {
+		return nil, nil
+	}
+	if s.size+len(ch.Data) > maxSize {
+		delete(a.streams, ch.Stream)
+		return nil, fmt.Errorf("%w: stream %d is over %d bytes", errChunk, ch.Stream, maxSize)
+	}
+	s.parts[ch.Seq] = append([]byte{}, ch.Data...)
+	s.got++
+	s.size += len(ch.Data)
+	if s.got < ch.Total {
+		return nil, nil
+	}
+	delete(a.streams, ch.Stream)
+	full := make([]byte, 0, s.size)
+	for _, p := range s.parts {
+		full = append(full, p...)
+	}
+	return full, nil
+}
+
+// Status lists the chunks of stream still missing. A stream it has no part
+// of is missing all total chunks, which must be a Total Add would accept.
+func (a *ChunkAssembler) Status(stream uint32, total int) (*ChunkStatus, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	status := &ChunkStatus{Stream: stream, Missing: []int{}}
+	s := a.streams[stream]
+	if s != nil {
+		total = len(s.parts)
+	} else if _, maxChunks := a.limits(); total <= 0 || total > maxChunks {
+		return nil, fmt.Errorf("%w: total %d", errChunk, total)
+	}
+	for seq := 0; seq < total; seq++ {
+		if s == nil || s.parts[seq] == nil {
+			status.Missing = append(status.Missing, seq)
+		}
+	}
+	return status, nil
+}
+
+// sweep drops idle streams.
+func (a *ChunkAssembler) sweep(now time.Time) {
+	if a.streams == nil {
+		a.streams = make(map[uint32]*chunkStream)
+	}
+	idle := a.Idle
+	if idle <= 0 {
+		idle = time.Minute
+	}
+	for id, s := range a.streams {
+		if now.Sub(s.last) > idle {
+			delete(a.streams, id)
+		}
+	}
+}
+
+// makeRoom drops the streams that waited longest until another can start.
+func (a *ChunkAssembler) makeRoom() {
+	maxStreams := a.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = 4
+	}
+	for len(a.streams) >= maxStreams {
+		var oldest uint32
+		var last time.Time
+		for id, s := range a.streams {
+			if last.IsZero() || s.last.Before(last) {
+				oldest, last = id, s.last
+			}
+		}
+		delete(a.streams, oldest)
+	}
+}
+
+// handleChunk reassembles inbound incmds.Chunk messages and dispatches the
+// message once it is whole. The partial messages live on the UserConn, so an
+// upload carries on after the session is resumed.
+func (uConn *UserConn) handleChunk(ctx context.Context, m *RawMessage) bool {
+	if m.Cmd != incmds.Chunk {
+		return false
+	}
+	ch := &Chunk{}
+	if logger.Check(json.Unmarshal(m.Data, ch)) {
+		return true
+	}
+	full, err := uConn.chunks.Add(ch)
+	if m.Id > 0 {
+		status, err := uConn.chunks.Status(ch.Stream, ch.Total)
+		if err != nil {
+			uConn.SendError(ctx, m.Id, NewError(CodeBadRequest, "Invalid chunk."))
+		} else {
+			uConn.SendRaw(ctx, &Message{Id: m.Id, Data: status})
+		}
+	}
+	if logger.Check(err) || full == nil {
+		return true
+	}
+	whole := &RawMessage{}
+	if logger.Check(decodeRawMessage(uConn.Codec(), full, whole)) {
+		return true
+	}
+	if whole.Cmd == incmds.Chunk {
+		logger.Error("Chunked message from", uConn.PrintName(), "was itself a chunk")
+		return true
+	}
+	uConn.dispatch(ctx, whole)
+	return true
+}
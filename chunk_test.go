@@ -0,0 +1,111 @@
+package qws
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+)
+
+func TestChunkAssemblerReordersAndResumes(t *testing.T) {
+	a := &ChunkAssembler{}
+	parts := [][]byte{[]byte("hel"), []byte("lo "), []byte("world")}
+	for _, seq := range []int{2, 0, 2} {
+		if full, err := a.Add(&Chunk{Stream: 1, Seq: seq, Total: 3, Data: parts[seq]}); full != nil || err != nil {
+			t.Fatalf("chunk %d completed %q, %v", seq, full, err)
+		}
+	}
+	if status, err := a.Status(1, 3); err != nil || !slices.Equal(status.Missing, []int{1}) {
+		t.Fatalf("missing %v, %v; want [1]", status, err)
+	}
+	full, err := a.Add(&Chunk{Stream: 1, Seq: 1, Total: 3, Data: parts[1]})
+	if err != nil || !bytes.Equal(full, []byte("hello world")) {
+		t.Fatalf("reassembled %q, %v", full, err)
+	}
+	if status, err := a.Status(1, 3); err != nil || len(status.Missing) != 3 {
+		t.Fatalf("a finished stream is still tracked: missing %v, %v", status, err)
+	}
+}
+
+func TestChunkAssemblerEnforcesLimits(t *testing.T) {
+	a := &ChunkAssembler{MaxSize: 4, MaxStreams: 2}
+	if _, err := a.Add(&Chunk{Stream: 1, Seq: 3, Total: 3}); err == nil {
+		t.Fatal("a seq past the total was accepted")
+	}
+	a.Add(&Chunk{Stream: 1, Seq: 0, Total: 2, Data: []byte("abc")})
+	if _, err := a.Add(&Chunk{Stream: 1, Seq: 1, Total: 2, Data: []byte("de")}); err == nil {
+		t.Fatal("a stream over MaxSize was accepted")
+	}
+	if _, err := a.Add(&Chunk{Stream: 2, Seq: 0, Total: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Add(&Chunk{Stream: 2, Seq: 1, Total: 4}); err == nil {
+		t.Fatal("a stream changed its total")
+	}
+	a.Add(&Chunk{Stream: 3, Seq: 0, Total: 3})
+	a.Add(&Chunk{Stream: 4, Seq: 0, Total: 2})
+	a.Add(&Chunk{Stream: 3, Seq: 1, Total: 2})
+	if len(a.streams) != 2 || a.streams[2] != nil {
+		t.Fatalf("kept %d streams; want the two newest", len(a.streams))
+	}
+}
+
+func TestChunkAssemblerBoundsTotal(t *testing.T) {
+	a := &ChunkAssembler{}
+	_, maxChunks := a.limits()
+	if _, err := a.Add(&Chunk{Stream: 1, Seq: 0, Total: maxChunks + 1}); err == nil || len(a.streams) != 0 {
+		t.Fatalf("a total of %d chunks was accepted", maxChunks+1)
+	}
+	if _, err := a.Status(1, MaxMessageSize); err == nil {
+		t.Fatal("status listed a total no stream could have")
+	}
+	if _, err := a.Add(&Chunk{Stream: 1, Seq: 0, Total: maxChunks}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkedSendKeepsGameFrames(t *testing.T) {
+	c := NewConn(nil, "")
+	c.SetChunked(true)
+	c.out.limit = 2
+	c.SendRaw(t.Context(), &Message{Id: 1, Data: strings.Repeat("x", MaxJsonSize)})
+	c.SendRaw(t.Context(), &Message{Cmd: outcmds.Turn})
+	if s := c.OutboxStats(); s.Dropped != 0 {
+		t.Fatalf("dropped = %d, want 0", s.Dropped)
+	}
+
+	a := &ChunkAssembler{}
+	var full []byte
+	turns := 0
+	for m := c.out.pop(time.Now()); m != nil; m = c.out.pop(time.Now()) {
+		var msg struct {
+			Cmd  outcmds.Cmd `json:"cmd"`
+			Data *Chunk      `json:"data"`
+		}
+		if err := json.Unmarshal(m.Data(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Cmd == outcmds.Turn {
+			turns++
+			continue
+		}
+		b, err := a.Add(msg.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b != nil {
+			full = b
+		}
+	}
+	if turns != 1 {
+		t.Fatalf("got %d turns, want 1", turns)
+	}
+	var reply Message
+	if err := json.Unmarshal(full, &reply); err != nil || reply.Id != 1 {
+		t.Fatalf("reassembled reply %d, %v", reply.Id, err)
+	}
+}
@@ -0,0 +1,22 @@
+// Command qwsgen writes the qws protocol as protocol.ts and
+// protocol.schema.json for the web client.
+//
+// It knows the command enums and the payloads declared in qws. The routes of
+// a server are only known to the server's own binary, which should call
+// protogen.WriteFiles after registering them.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/amh11706/qws/protogen"
+)
+
+func main() {
+	out := flag.String("out", ".", "directory to write the generated files to")
+	flag.Parse()
+	if err := protogen.WriteFiles(*out); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,348 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amh11706/logger"
+)
+
+// Kinds of slash command parameter. An enum parameter lists its values
+// instead, separated by |.
+const (
+	ParamString   = "string"
+	ParamUser     = "user"
+	ParamInt      = "int"
+	ParamDuration = "duration"
+	ParamEnum     = "enum"
+)
+
+// Param is one parameter declared in a Command's Params. Params is a space
+// separated list of parameters, each written as
+//
+//	<name>           required
+//	[name]           optional, empty when left out
+//	[name=default]   optional with a default
+//	name             optional, as Params were before they had kinds
+//
+// where name may be followed by :kind, like <target:user>, [minutes:duration=5m]
+// or <team:red|blue>. The last parameter takes the rest of the line as typed
+// when it is a string. Other arguments are separated by spaces. Those of
+// parameters declared with brackets or a kind can be quoted with " or ', and
+// \ escapes the next character; those of bare names are taken as typed.
+type Param struct {
+	Name     string
+	Kind     string
+	Values   []string
+	Optional bool
+	Default  string
+	// Rest is set on a last string parameter.
+	Rest bool
+	// Plain is set on a parameter declared as a bare name, whose argument
+	// is not unquoted.
+	Plain bool
+}
+
+var parsedParams sync.Map // string -> []Param
+
+// ParseParams parses a Command's Params.
+func ParseParams(spec string) ([]Param, error) {
+	if cached, ok := parsedParams.Load(spec); ok {
+		return cached.([]Param), nil
+	}
+	var params []Param
+	for _, field := range strings.Fields(spec) {
+		p := Param{Optional: true}
+		switch {
+		case strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">"):
+			p.Optional = false
+			field = field[1 : len(field)-1]
+		case strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]"):
+			field = field[1 : len(field)-1]
+		default:
+			p.Plain = !strings.Contains(field, ":")
+		}
+		field, def, hasDefault := strings.Cut(field, "=")
+		if hasDefault && !p.Optional {
+			return nil, fmt.Errorf("required parameter %s has a default", field)
+		}
+		name, kind, _ := strings.Cut(field, ":")
+		p.Name, p.Default = name, def
+		switch {
+		case kind == "" || kind == ParamString:
+			p.Kind = ParamString
+		case kind == ParamUser || kind == ParamInt || kind == ParamDuration:
+			p.Kind = kind
+		case strings.Contains(kind, "|"):
+			p.Kind, p.Values = ParamEnum, strings.Split(kind, "|")
+		default:
+			return nil, fmt.Errorf("parameter %s has unknown kind %q", name, kind)
+		}
+		if hasDefault {
+			if _, _, err := p.convert(def); err != nil {
+				return nil, fmt.Errorf("default of %s: %w", name, err)
+			}
+		}
+		params = append(params, p)
+	}
+	if n := len(params); n > 0 && params[n-1].Kind == ParamString {
+		params[n-1].Rest = true
+	}
+	parsedParams.Store(spec, params)
+	return params, nil
+}
+
+// convert checks s against the parameter's kind and returns it as the
+// handler gets it and as its typed value.
+func (p Param) convert(s string) (string, interface{}, error) {
+	switch p.Kind {
+	case ParamUser:
+		name, copy, err := parseUserArg(s)
+		if err != nil {
+			return "", nil, err
+		}
+		if copy >= 0 {
+			return fmt.Sprintf("%s(%d)", name, copy), UserArg{name, copy}, nil
+		}
+		return name, UserArg{name, copy}, nil
+	case ParamInt:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return "", nil, errors.New("must be a whole number")
+		}
+		return s, n, nil
+	case ParamDuration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return "", nil, errors.New("must be a duration like 10m or 1h30m")
+		}
+		return s, d, nil
+	case ParamEnum:
+		for _, v := range p.Values {
+			if strings.EqualFold(s, v) {
+				return v, v, nil
+			}
+		}
+		return "", nil, errors.New("must be one of " + strings.Join(p.Values, ", "))
+	}
+	return s, s, nil
+}
+
+// UserArg is the value of a user parameter. Copy is -1 when the name did
+// not pick one, as with ParseName.
+type UserArg struct {
+	Name string
+	Copy int64
+}
+
+func parseUserArg(s string) (string, int64, error) {
+	if s == "" || strings.ContainsFunc(s, func(r rune) bool { return r < ' ' }) {
+		return "", 0, errors.New("must be a user name")
+	}
+	base, copy, hasCopy := strings.Cut(s, "(")
+	if !hasCopy {
+		return FormatName(s), -1, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(copy, ")"), 10, 64)
+	if base == "" || !strings.HasSuffix(copy, ")") || err != nil || n < 0 {
+		return "", 0, errors.New("must be a user name, like Name or Name(2)")
+	}
+	return FormatName(base), n, nil
+}
+
+// nextArg reads the argument at or after pos. A plain argument runs to the
+// next space as typed; any other honours quotes and escapes. It returns the
+// argument, where the input after it starts, and whether there was one.
+func nextArg(input string, pos int, plain bool) (string, int, bool, error) {
+	for pos < len(input) && (input[pos] == ' ' || input[pos] == '\t') {
+		pos++
+	}
+	if pos == len(input) {
+		return "", pos, false, nil
+	}
+	if plain {
+		end := strings.IndexAny(input[pos:], " \t")
+		if end < 0 {
+			return input[pos:], len(input), true, nil
+		}
+		return input[pos : pos+end], pos + end, true, nil
+	}
+	var b strings.Builder
+	escaped := false
+	var quote rune
+	for i, r := range input[pos:] {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ' ' || r == '\t':
+			return b.String(), pos + i, true, nil
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return "", 0, false, errors.New("Unterminated quote.")
+	}
+	if escaped {
+		b.WriteByte('\\')
+	}
+	return b.String(), len(input), true, nil
+}
+
+// splitPlain splits input the way Params were before they had kinds: on
+// each space, with the last parameter taking the rest of the line.
+func splitPlain(input string, n int) []string {
+	params := make([]string, 0, n)
+	last := 0
+	for i := 0; i < len(input) && len(params) < n-1; i++ {
+		if input[i] == ' ' {
+			params = append(params, input[last:i])
+			last = i + 1
+		}
+	}
+	if len(input) > last {
+		params = append(params, input[last:])
+	}
+	for len(params) < n {
+		params = append(params, "")
+	}
+	return params
+}
+
+// Args are a command's arguments converted to their parameters' kinds. A
+// parameter that was left out without a default has its kind's zero value.
+type Args struct {
+	params []Param
+	values []interface{}
+}
+
+func (a Args) value(name string) interface{} {
+	for i, p := range a.params {
+		if p.Name == name {
+			return a.values[i]
+		}
+	}
+	return nil
+}
+
+func (a Args) String(name string) string {
+	s, _ := a.value(name).(string)
+	return s
+}
+
+func (a Args) Int(name string) int {
+	n, _ := a.value(name).(int)
+	return n
+}
+
+func (a Args) Duration(name string) time.Duration {
+	d, _ := a.value(name).(time.Duration)
+	return d
+}
+
+func (a Args) User(name string) UserArg {
+	u, ok := a.value(name).(UserArg)
+	if !ok {
+		return UserArg{Copy: -1}
+	}
+	return u
+}
+
+type cmdArgsKey struct{}
+
+// CmdArgs returns the arguments of the slash command being handled.
+func CmdArgs(ctx context.Context) Args {
+	args, _ := ctx.Value(cmdArgsKey{}).(Args)
+	return args
+}
+
+// parseArgs binds input to the command's Params. It returns the handler's
+// params, the typed arguments, and the message for the user if input does
+// not fit.
+func (c Command) parseArgs(input string) ([]string, Args, string) {
+	params, err := ParseParams(c.Params)
+	if logger.Check(err) {
+		return nil, Args{}, "Something went wrong..."
+	}
+	if len(params) == 0 {
+		return nil, Args{}, ""
+	}
+	usage := func(problem string) string {
+		return problem + " Usage: " + c.Base + " " + c.Params
+	}
+
+	if !slices.ContainsFunc(params, func(p Param) bool { return !p.Plain }) {
+		out := splitPlain(input, len(params))
+		args := Args{params: params, values: make([]interface{}, len(params))}
+		for i, v := range out {
+			args.values[i] = v
+		}
+		return out, args, ""
+	}
+
+	out := make([]string, len(params))
+	args := Args{params: params, values: make([]interface{}, len(params))}
+	pos := 0
+	for i, p := range params {
+		var s string
+		given := false
+		if p.Rest {
+			s = strings.TrimSpace(input[pos:])
+			pos, given = len(input), s != ""
+		} else {
+			var err error
+			s, pos, given, err = nextArg(input, pos, p.Plain)
+			if err != nil {
+				return nil, Args{}, usage(err.Error())
+			}
+		}
+		if !given {
+			if !p.Optional {
+				return nil, Args{}, usage("Missing " + p.Name + ".")
+			}
+			s = p.Default
+		}
+		if s == "" && p.Optional {
+			args.values[i] = zeroArg(p.Kind)
+			continue
+		}
+		norm, value, err := p.convert(s)
+		if err != nil {
+			return nil, Args{}, usage(p.Name + " " + err.Error() + ".")
+		}
+		out[i], args.values[i] = norm, value
+	}
+	if _, _, extra, _ := nextArg(input, pos, true); extra {
+		return nil, Args{}, usage("Too many arguments.")
+	}
+	return out, args, ""
+}
+
+func zeroArg(kind string) interface{} {
+	switch kind {
+	case ParamUser:
+		return UserArg{Copy: -1}
+	case ParamInt:
+		return 0
+	case ParamDuration:
+		return time.Duration(0)
+	}
+	return ""
+}
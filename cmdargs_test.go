@@ -0,0 +1,72 @@
+package qws
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	kick := Command{Base: "/kick", Params: "<target:user> [reason]"}
+	params, args, usage := kick.parseArgs(`"sOME name(2)"   griefing  a lot`)
+	if usage != "" || !slices.Equal(params, []string{"Some name(2)", "griefing  a lot"}) {
+		t.Fatalf("got %q, %q", params, usage)
+	}
+	if u := args.User("target"); u.Name != "Some name" || u.Copy != 2 || args.String("reason") != "griefing  a lot" {
+		t.Fatalf("typed args are %+v, %q", u, args.String("reason"))
+	}
+	if _, _, usage := kick.parseArgs(""); usage != "Missing target. Usage: /kick <target:user> [reason]" {
+		t.Fatalf("usage was %q", usage)
+	}
+
+	mute := Command{Base: "/mute", Params: "<target:user> [minutes:duration=5m] [scope:lobby|global=lobby]"}
+	if _, _, usage := mute.parseArgs(`bob 'one''s' GLOBAL`); !strings.Contains(usage, "minutes must be a duration") {
+		t.Fatalf("bad duration gave %q", usage)
+	}
+	_, args, usage = mute.parseArgs(`bob`)
+	if usage != "" || args.Duration("minutes") != 5*time.Minute || args.String("scope") != "lobby" {
+		t.Fatalf("defaults gave %q, %v, %q", usage, args.Duration("minutes"), args.String("scope"))
+	}
+	params, _, usage = mute.parseArgs(`bob 1h Global`)
+	if usage != "" || !slices.Equal(params, []string{"Bob", "1h", "global"}) {
+		t.Fatalf("got %q, %q", params, usage)
+	}
+	if _, _, usage := mute.parseArgs(`bob 1h everywhere`); !strings.Contains(usage, "scope must be one of lobby, global") {
+		t.Fatalf("bad enum gave %q", usage)
+	}
+	if _, _, usage := mute.parseArgs(`bob 1h lobby extra`); !strings.HasPrefix(usage, "Too many arguments.") {
+		t.Fatalf("extra argument gave %q", usage)
+	}
+	if _, _, usage := mute.parseArgs(`"bob`); !strings.HasPrefix(usage, "Unterminated quote.") {
+		t.Fatalf("open quote gave %q", usage)
+	}
+}
+
+func TestParseArgsKeepsUntypedParams(t *testing.T) {
+	tell := Command{Base: "/tell", Params: "name message"}
+	params, _, usage := tell.parseArgs("")
+	if usage != "" || !slices.Equal(params, []string{"", ""}) {
+		t.Fatalf("empty input gave %q, %q", params, usage)
+	}
+	for input, want := range map[string][]string{
+		"bob it's fine":         {"bob", "it's fine"},
+		`bob C:\path  "quoted"`: {"bob", `C:\path  "quoted"`},
+	} {
+		params, _, usage = tell.parseArgs(input)
+		if usage != "" || !slices.Equal(params, want) {
+			t.Fatalf("%q gave %q, %q", input, params, usage)
+		}
+	}
+	if params, _, _ := (Command{Base: "/help"}).parseArgs("anything"); params != nil {
+		t.Fatalf("command without params got %q", params)
+	}
+}
+
+func TestParseParamsRejectsBadDeclarations(t *testing.T) {
+	for _, spec := range []string{"<n:float>", "<n=1>", "[n:int=x]"} {
+		if _, err := ParseParams(spec); err == nil {
+			t.Errorf("%q parsed", spec)
+		}
+	}
+}
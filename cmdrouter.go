@@ -11,6 +11,9 @@ var cmdLogger = NewCommandLogger("commands", commandLog{})
 
 type CmdHandler func(ctx context.Context, c UserConner, params []string) string
 
+// Command is a slash command. Params declares its parameters, see Param, and
+// the handler gets one string per parameter once the input fits them. The
+// typed values are in CmdArgs.
 type Command struct {
 	Base    string     `json:"base"`
 	Params  string     `json:"params"`
@@ -29,6 +32,8 @@ type CmdRouter struct {
 	Global     []Command `json:"global"`
 	Lobby      []Command `json:"lobby"`
 	LobbyAdmin []Command `json:"lobbyAdmin"`
+
+	middleware []CmdMiddleware
 }
 
 func (r *CmdRouter) ServeWS(ctx context.Context, c *UserConn, m *RawMessage) {
@@ -54,34 +59,15 @@ func (r *CmdRouter) ServeWS(ctx context.Context, c *UserConn, m *RawMessage) {
 	defer log.End(ctx)
 
 	match := r.findHandler(cmd)
-	var params []string
-	if len(match.Params) > 0 {
-		wantParams := 1
-		for _, c := range match.Params {
-			if c == ' ' {
-				wantParams++
-			}
-		}
-		params = make([]string, 0, wantParams)
-		last := 0
-		for i := 0; i < len(input) && wantParams > 1; i++ {
-			if input[i] == ' ' {
-				params = append(params, string(input[last:i]))
-				last = i + 1
-				wantParams--
-			}
-		}
-		if len(input) > last {
-			params = append(params, string(input[last:]))
-			wantParams--
-		}
-		for wantParams > 0 {
-			params = append(params, "")
-			wantParams--
-		}
+	params, args, usage := match.parseArgs(input)
+	if usage != "" {
+		c.SendInfo(ctx, usage)
+		log.Status(usage)
+		return
 	}
+	ctx = context.WithValue(ctx, cmdArgsKey{}, args)
 
-	if res := match.Handler(ctx, c, params); len(res) > 0 {
+	if res := chainCmd(match.Handler, r.middleware)(ctx, c, params); len(res) > 0 {
 		c.SendInfo(ctx, res)
 		log.Status(res)
 	} else {
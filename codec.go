@@ -0,0 +1,415 @@
+package qws
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec is the wire format of a connection. It is picked once per connection
+// from the websocket subprotocol the client asked for, see CodecFor.
+type Codec interface {
+	// Name is the websocket subprotocol that selects this codec.
+	Name() string
+	// FrameType is the websocket frame type messages are sent as.
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+	CBORCodec    Codec = cborCodec{}
+)
+
+// Subprotocols lists every codec name in order of preference. It is meant for
+// websocket.Upgrader.Subprotocols so the upgrade picks the codec the client
+// asked for. A client that asks for none of them gets JSON.
+var Subprotocols = []string{MsgpackCodec.Name(), CBORCodec.Name(), JSONCodec.Name()}
+
+// CodecFor returns the codec for a negotiated subprotocol, defaulting to JSON.
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case MsgpackCodec.Name():
+		return MsgpackCodec
+	case CBORCodec.Name():
+		return CBORCodec
+	}
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string   { return "qws.json" }
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// Binary codecs follow the json struct tags so payload types only need to be
+// annotated once. They cannot see MarshalJSON though, so a type that shapes
+// its own JSON (UserConn, UserList and the like) has its JSON output
+// transcoded instead. CBOR does that for every such type on its own; msgpack
+// has the types registered as values of them are first encoded.
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string   { return "qws.msgpack" }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	registerJSONMarshalers(reflect.ValueOf(v))
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeFor[json.Marshaler]()
+	msgpackEncoderTypes = []reflect.Type{
+		reflect.TypeFor[msgpack.CustomEncoder](),
+		reflect.TypeFor[msgpack.Marshaler](),
+		reflect.TypeFor[encoding.BinaryMarshaler](),
+	}
+	// msgpackTypes maps each type encoded with msgpack to whether its values
+	// can hold interfaces, whose json.Marshalers are only known from the
+	// values.
+	msgpackTypes sync.Map
+)
+
+// registerJSONMarshalers registers the json.Marshalers v holds with msgpack
+// before v is encoded, so they are encoded through their MarshalJSON.
+func registerJSONMarshalers(v reflect.Value) {
+	if !v.IsValid() || !holdsInterfaces(v.Type()) {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if !v.IsNil() {
+			registerJSONMarshalers(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() && holdsInterfaces(f.Type) {
+				registerJSONMarshalers(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if holdsInterfaces(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				registerJSONMarshalers(v.Index(i))
+			}
+		}
+	case reflect.Map:
+		keys, values := holdsInterfaces(v.Type().Key()), holdsInterfaces(v.Type().Elem())
+		if keys || values {
+			for it := v.MapRange(); it.Next(); {
+				registerJSONMarshalers(it.Key())
+				registerJSONMarshalers(it.Value())
+			}
+		}
+	}
+}
+
+// holdsInterfaces registers the json.Marshalers among the types a value of
+// t is made of, once per t, and reports whether it can also hold interfaces.
+func holdsInterfaces(t reflect.Type) bool {
+	if dynamic, ok := msgpackTypes.Load(t); ok {
+		return dynamic.(bool)
+	}
+	dynamic := scanMsgpackType(t, make(map[reflect.Type]bool))
+	msgpackTypes.Store(t, dynamic)
+	return dynamic
+}
+
+func scanMsgpackType(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	if t.Kind() == reflect.Interface {
+		return true
+	}
+	for _, enc := range msgpackEncoderTypes {
+		// msgpack encodes these its own way, like time.Time as an extension.
+		if t.Implements(enc) {
+			return false
+		}
+	}
+	if t.Implements(jsonMarshalerType) {
+		msgpack.Register(reflect.Zero(t).Interface(), encodeMsgpackJSON, nil)
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return scanMsgpackType(t.Elem(), seen)
+	case reflect.Map:
+		keys := scanMsgpackType(t.Key(), seen)
+		return scanMsgpackType(t.Elem(), seen) || keys
+	case reflect.Struct:
+		dynamic := false
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() && scanMsgpackType(f.Type, seen) {
+				dynamic = true
+			}
+		}
+		return dynamic
+	}
+	return false
+}
+
+func encodeMsgpackJSON(e *msgpack.Encoder, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return e.EncodeNil()
+	}
+	b, err := v.Interface().(json.Marshaler).MarshalJSON()
+	if err != nil {
+		return err
+	}
+	tree, err := decodeJSONTree(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return e.Encode(tree)
+}
+
+type cborCodec struct{}
+
+var cborEnc, cborDec = func() (cbor.EncMode, cbor.DecMode) {
+	plain, err := cbor.EncOptions{}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	enc, err := cbor.EncOptions{
+		JSONMarshalerTranscoder: transcoderFunc(func(w io.Writer, r io.Reader) error {
+			tree, err := decodeJSONTree(r)
+			if err != nil {
+				return err
+			}
+			return plain.NewEncoder(w).Encode(tree)
+		}),
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	// Generic maps are decoded with string keys so that inbound data can be
+	// handed on to json.Marshal, see decodeRawMessage.
+	dec, err := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return enc, dec
+}()
+
+func (cborCodec) Name() string   { return "qws.cbor" }
+func (cborCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cborEnc.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cborDec.Unmarshal(data, v)
+}
+
+type transcoderFunc func(io.Writer, io.Reader) error
+
+func (f transcoderFunc) Transcode(w io.Writer, r io.Reader) error {
+	return f(w, r)
+}
+
+// decodeJSONTree decodes JSON into plain maps and slices, keeping integers as
+// integers so binary codecs can pick their compact encodings for them.
+func decodeJSONTree(r io.Reader) (interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return normalizeJSONNumbers(tree), nil
+}
+
+func normalizeJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalizeJSONNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalizeJSONNumbers(e)
+		}
+	}
+	return v
+}
+
+// wireRawMessage is how RawMessage is decoded from binary codecs, whose data
+// cannot be kept as a json.RawMessage.
+type wireRawMessage struct {
+	Cmd  incmds.Cmd  `json:"cmd,omitempty"`
+	Id   uint32      `json:"id,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// decodeRawMessage decodes an inbound frame. Handlers only ever deal in JSON,
+// so data from a binary codec is re-encoded as JSON here. Inbound messages are
+// small, the savings of a binary codec are all on the outbound side.
+func decodeRawMessage(codec Codec, data []byte, m *RawMessage) error {
+	if codec == JSONCodec {
+		return json.Unmarshal(data, m)
+	}
+	var w wireRawMessage
+	if err := codec.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	m.Cmd = w.Cmd
+	m.Id = w.Id
+	m.Data = nil
+	if w.Data != nil {
+		b, err := json.Marshal(w.Data)
+		if err != nil {
+			return err
+		}
+		m.Data = b
+	}
+	return nil
+}
+
+// preparedSet encodes a message once for every codec it is asked for, so a
+// broadcast costs one encode per codec rather than one per recipient.
+type preparedSet struct {
+	cmd      outcmds.Cmd
+	data     interface{}
+	prepared map[Codec]*Frame
+	// keyed makes the frames keyed frames under key.
+	key   string
+	keyed bool
+}
+
+func newPreparedSet(cmd outcmds.Cmd, data interface{}) *preparedSet {
+	return &preparedSet{cmd: cmd, data: data}
+}
+
+func (s *preparedSet) get(codec Codec) (*Frame, error) {
+	if f, ok := s.prepared[codec]; ok {
+		return f, nil
+	}
+	m, err := PrepareMessage(codec, s.cmd, s.data)
+	if err != nil {
+		return nil, err
+	}
+	if s.prepared == nil {
+		s.prepared = make(map[Codec]*Frame, 1)
+	}
+	f := NewFrame(s.cmd, m)
+	if s.keyed {
+		f = NewKeyedFrame(s.cmd, s.key, m)
+	}
+	s.prepared[codec] = f
+	if m.large != nil {
+		m.large.hold()
+	}
+	return f, nil
+}
+
+// done lets offloaded frames go once every recipient was sent them. Until
+// then a recipient that fetched its copy does not remove it from under the
+// recipients still waiting for their grant.
+func (s *preparedSet) done() {
+	for _, f := range s.prepared {
+		if f.Message.large != nil {
+			f.Message.large.release()
+		}
+	}
+}
+
+// ClientMessage is an outbound message decoded the way a client sees it.
+type ClientMessage struct {
+	Cmd  outcmds.Cmd     `json:"cmd"`
+	Id   uint32          `json:"id"`
+	Data json.RawMessage `json:"data"`
+	// Error is the failure of the request with Id, if it failed.
+	Error *Error `json:"error,omitempty"`
+	// More marks a partial result of the request with Id.
+	More bool `json:"more,omitempty"`
+}
+
+// wireClientMessage is an outbound frame before its data is turned into JSON.
+// HttpId is set for messages offloaded to HandleHttpMessage.
+type wireClientMessage struct {
+	Cmd    outcmds.Cmd `json:"cmd,omitempty"`
+	Id     uint32      `json:"id,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  *Error      `json:"error,omitempty"`
+	More   bool        `json:"more,omitempty"`
+	HttpId string      `json:"httpid,omitempty"`
+}
+
+// DecodeClientMessage decodes an outbound frame, fetching it from the offload
+// store first if it was too large to send inline. It is for in-process
+// clients like bots and tests, which read offloaded messages with their
+// connection's FetchKey.
+func DecodeClientMessage(codec Codec, data []byte, fetchKey string) (*ClientMessage, error) {
+	var w wireClientMessage
+	if err := codec.Unmarshal(data, &w); err != nil {
+		return nil, err
+	}
+	if w.HttpId != "" {
+		id, err := uuid.Parse(w.HttpId)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := Offloads.Get(context.Background(), id, fetchKey)
+		if err != nil {
+			return nil, fmt.Errorf("offloaded message %s: %w", id, err)
+		}
+		return DecodeClientMessage(codec, msg.Data, fetchKey)
+	}
+	m := &ClientMessage{Cmd: w.Cmd, Id: w.Id, Error: w.Error, More: w.More}
+	if w.Data != nil {
+		b, err := json.Marshal(w.Data)
+		if err != nil {
+			return nil, err
+		}
+		m.Data = b
+	}
+	return m, nil
+}
@@ -0,0 +1,117 @@
+package qws
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+	"github.com/amh11706/qws/slice"
+)
+
+func TestBinaryCodecsDecodeRawMessageDataAsJSON(t *testing.T) {
+	for _, codec := range []Codec{MsgpackCodec, CBORCodec} {
+		b, err := codec.Marshal(map[string]interface{}{
+			"cmd":  int(incmds.Moves),
+			"id":   7,
+			"data": map[string]interface{}{"moves": []int{1, 0, 2}, "shots": "x"},
+		})
+		if err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		m := &RawMessage{}
+		if err := decodeRawMessage(codec, b, m); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if m.Cmd != incmds.Moves || m.Id != 7 {
+			t.Fatalf("%s: decoded cmd=%d id=%d", codec.Name(), m.Cmd, m.Id)
+		}
+		var data struct {
+			Moves []int  `json:"moves"`
+			Shots string `json:"shots"`
+		}
+		if err := json.Unmarshal(m.Data, &data); err != nil {
+			t.Fatalf("%s: data is not JSON: %s: %v", codec.Name(), m.Data, err)
+		}
+		if len(data.Moves) != 3 || data.Moves[2] != 2 || data.Shots != "x" {
+			t.Fatalf("%s: data did not survive: %s", codec.Name(), m.Data)
+		}
+	}
+}
+
+func TestBinaryCodecsUseMarshalJSONShape(t *testing.T) {
+	c := &UserConn{SId: 3, Copy: 2, user: &User{Name: "Somebody"}}
+	for _, codec := range []Codec{MsgpackCodec, CBORCodec} {
+		b, err := codec.Marshal(&Message{Cmd: outcmds.PlayerAdd, Data: c})
+		if err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		var m struct {
+			Cmd  outcmds.Cmd `json:"cmd"`
+			Data struct {
+				From string `json:"from"`
+				Copy int64  `json:"copy"`
+				SId  int64  `json:"sId"`
+			} `json:"data"`
+		}
+		if err := codec.Unmarshal(b, &m); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if m.Cmd != outcmds.PlayerAdd || m.Data.From != "Somebody" || m.Data.Copy != 2 || m.Data.SId != 3 {
+			t.Fatalf("%s: UserConn did not encode as a Player: %+v", codec.Name(), m)
+		}
+	}
+}
+
+func TestMsgpackUsesMarshalJSONOfAnyType(t *testing.T) {
+	list := slice.NewVisibleCheckerMap(map[int]string{1: "a", 2: "b"}, func(v string) bool { return v == "b" })
+	b, err := MsgpackCodec.Marshal(&Message{Cmd: outcmds.PlayerList, Data: []interface{}{list}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Data [][]string `json:"data"`
+	}
+	if err := MsgpackCodec.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Data) != 1 || !slices.Equal(m.Data[0], []string{"b"}) {
+		t.Fatalf("list encoded as %v, want [[b]]", m.Data)
+	}
+}
+
+func TestPreparedSetEncodesOncePerCodec(t *testing.T) {
+	set := newPreparedSet(outcmds.Sync, []int{1, 2, 3})
+	a, err := set.get(JSONCodec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := set.get(JSONCodec)
+	if a != b {
+		t.Fatal("second JSON recipient got a fresh encode")
+	}
+	c, _ := set.get(MsgpackCodec)
+	if c == a {
+		t.Fatal("msgpack recipient got the JSON encode")
+	}
+	if len(set.prepared) != 2 {
+		t.Fatalf("expected 2 encodes, got %d", len(set.prepared))
+	}
+}
+
+func TestSendMessageNeedsJSONConnection(t *testing.T) {
+	m, err := PrepareJsonMessage(outcmds.Sync, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		c := NewConn(nil, "")
+		c.codec = codec
+		c.SendMessage(t.Context(), m)
+		if queued := c.out.pop(time.Now()) != nil; queued != (codec == JSONCodec) {
+			t.Errorf("%s connection queued a JSON message: %v", codec.Name(), queued)
+		}
+	}
+}
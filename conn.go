@@ -2,10 +2,14 @@ package qws
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/amh11706/logger"
@@ -20,12 +24,18 @@ type RawMessage struct {
 	Cmd  incmds.Cmd      `json:"cmd,omitempty"`
 	Id   uint32          `json:"id,omitempty"`
 	Data json.RawMessage `json:"data,omitempty"`
+
+	req *runningRequest
 }
 
 type Message struct {
 	Cmd  outcmds.Cmd `json:"cmd,omitempty"`
 	Id   uint32      `json:"id,omitempty"`
 	Data interface{} `json:"data,omitempty"`
+	// Error is set instead of Data when the request with Id failed.
+	Error *Error `json:"error,omitempty"`
+	// More marks a partial result, with more to follow for the same Id.
+	More bool `json:"more,omitempty"`
 }
 
 type Info struct {
@@ -36,12 +46,29 @@ type Info struct {
 const connectionTimeout = 10 * time.Second
 
 type Conn struct {
-	conn                *websocket.Conn
-	sendChan            chan *websocket.PreparedMessage
-	closed              bool
+	conn                Transport
+	out                 *outbox
+	closed              atomic.Bool
 	ip                  string
 	pingTimer           *time.Ticker
-	lastMessageReceived time.Time
+	lastMessageReceived atomic.Int64
+	codec               Codec
+	// fetchKey is what the client presents to fetch its offloaded messages.
+	fetchKey string
+	// chunked sends large messages as chunks instead of offloading them.
+	chunked atomic.Bool
+
+	// writeLock is held while a frame is numbered and written, so frames
+	// reach the socket in the order the session history numbers them.
+	writeLock sync.Mutex
+	// sockLock guards swapping conn when a session is resumed, along with
+	// the rest of the session state below.
+	sockLock     sync.Mutex
+	session      *session
+	socketGen    uint32
+	readerGen    uint32
+	writerCancel context.CancelFunc
+	writerDone   chan struct{}
 }
 
 // MaxHandshakeSize bounds the login frame, which is read before the connection
@@ -56,23 +83,81 @@ const MaxHandshakeSize = 4 * 1024
 // rather than near the size of a typical save.
 const MaxMessageSize = 8 * 1024 * 1024
 
+// NewConn wraps a websocket. Bots are built with a nil conn.
 func NewConn(conn *websocket.Conn, ip string) *Conn {
-	c := &Conn{
-		conn:                conn,
-		sendChan:            make(chan *websocket.PreparedMessage, 50),
-		ip:                  ip,
-		lastMessageReceived: time.Now(),
-		pingTimer:           time.NewTicker(connectionTimeout / 2),
+	if conn == nil {
+		return NewTransportConn(nil, ip)
 	}
-	// Bots are built with a nil conn.
+	return NewTransportConn(NewWebsocketTransport(conn), ip)
+}
+
+func NewTransportConn(conn Transport, ip string) *Conn {
+	c := &Conn{
+		conn:      conn,
+		out:       newOutbox(),
+		ip:        ip,
+		pingTimer: time.NewTicker(connectionTimeout / 2),
+		codec:     JSONCodec,
+		fetchKey:  newFetchKey(),
+	}
+	c.lastMessageReceived.Store(time.Now().UnixNano())
 	if conn != nil {
 		conn.SetReadLimit(MaxMessageSize)
+		c.codec = CodecFor(conn.Subprotocol())
 	}
 	return c
 }
 
+// Codec is the wire format negotiated for this connection.
+func (c *Conn) Codec() Codec {
+	if c == nil || c.codec == nil {
+		return JSONCodec
+	}
+	return c.codec
+}
+
+// ListenWrite starts writing queued messages to the socket. It also sends
+// the client the connection's FetchKey, so clients can fetch their offloaded
+// messages however their connection was made.
 func (c *Conn) ListenWrite(ctx context.Context) {
-	go c.listenWrite(ctx)
+	SendTyped(ctx, c, outcmds.FetchKeyCmd, c.FetchKey())
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	c.sockLock.Lock()
+	ws := c.conn
+	c.writerCancel, c.writerDone = cancel, done
+	c.sockLock.Unlock()
+	go func() {
+		defer close(done)
+		defer cancel()
+		c.listenWrite(ctx, ws)
+	}()
+}
+
+// stopWriter stops the running listenWrite and waits for it to return.
+func (c *Conn) stopWriter(ctx context.Context) error {
+	c.sockLock.Lock()
+	cancel, done := c.writerCancel, c.writerDone
+	c.writerCancel, c.writerDone = nil, nil
+	c.sockLock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// socket returns the current websocket and its generation, which changes
+// every time a session is resumed onto a new one.
+func (c *Conn) socket() (Transport, uint32) {
+	c.sockLock.Lock()
+	defer c.sockLock.Unlock()
+	return c.conn, c.socketGen
 }
 
 type UserInfoer interface {
@@ -106,19 +191,35 @@ type UserConn struct {
 	inLobby    int64
 	Ghosted    bool
 	closeHooks []CloseHandler
+	inbound    *dispatcher
+	requests   requests
+	chunks     ChunkAssembler
+	bot        bool
+	life       life
+	running    running
 }
 
 func NewUserConn(user *User, conn *websocket.Conn, ip string) *UserConn {
+	if conn == nil {
+		return NewTransportUserConn(user, nil, ip)
+	}
+	return NewTransportUserConn(user, NewWebsocketTransport(conn), ip)
+}
+
+func NewTransportUserConn(user *User, conn Transport, ip string) *UserConn {
 	uConn := &UserConn{
 		user:       user,
-		Conn:       NewConn(conn, ip),
+		Conn:       NewTransportConn(conn, ip),
 		router:     &Router{},
 		cmdRouter:  &CmdRouter{},
 		closeHooks: make([]CloseHandler, 0, 4),
+		inbound:    newDispatcher(),
 	}
 	return uConn
 }
 
+// NewBot makes a bot that has no connection at all, so nothing sent to it is
+// delivered anywhere. Use NewBotConn for a bot that reacts to server events.
 func NewBot(id int64, user *User) *UserConn {
 	return &UserConn{SId: id, user: user}
 }
@@ -140,7 +241,7 @@ func (c *UserConn) Ip() string {
 }
 
 func (c *UserConn) IsBot() bool {
-	return c.Conn == nil
+	return c.Conn == nil || c.bot
 }
 
 func (c *UserConn) IsGhosted() bool {
@@ -232,7 +333,7 @@ func (c *UserConn) AddCloseHook(ctx context.Context, ch CloseHandler) error {
 		return err
 	}
 	defer c.user.Lock.Unlock()
-	if c.closed {
+	if c.closed.Load() {
 		return errors.New("connection closed")
 	}
 	c.closeHooks = append(c.closeHooks, ch)
@@ -274,6 +375,32 @@ func (c *UserConn) UserName() UserName {
 	return UserName{From: c.Name(), Copy: c.Copy, Admin: c.AdminLevel(), Decoration: string(c.user.Decoration)}
 }
 
+// Context is cancelled when the connection closes. Handlers already run
+// under it, so use it for work they start that should end with the
+// connection rather than with the handler.
+func (c *UserConn) Context() context.Context {
+	return c.life.context()
+}
+
+// life is the context of a UserConn, made on first use.
+type life struct {
+	start  sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (l *life) context() context.Context {
+	l.start.Do(func() {
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+	})
+	return l.ctx
+}
+
+func (l *life) end() {
+	l.context()
+	l.cancel()
+}
+
 func (c *UserConn) Close() {
 	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer cancel()
@@ -281,7 +408,7 @@ func (c *UserConn) Close() {
 	defer c.user.Lock.Unlock()
 	chs := c.closeHooks
 	c.closeHooks = nil
-	c.closed = true
+	c.closed.Store(true)
 	for i := len(chs) - 1; i >= 0; i-- {
 		safe.GoWithValue(func(h CloseHandler) {
 			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -289,23 +416,69 @@ func (c *UserConn) Close() {
 			(*h)(ctx, c)
 		}, chs[i], nil)
 	}
-	c.conn.Close()
+	if c.inbound != nil {
+		c.inbound.stop()
+	}
+	c.life.end()
+	c.requests.close()
+	if c.Conn == nil {
+		// Bots built by NewBot have no socket.
+		return
+	}
+	c.endSession()
+	if ws, _ := c.socket(); ws != nil {
+		ws.Close()
+	}
 }
 
 func (c *Conn) Close() {
-	c.conn.Close()
-	c.closed = true
+	ws, _ := c.socket()
+	c.dropSocket(ws)
+}
+
+// dropSocket closes ws. A resumable connection stays open for its client to
+// resume, anything else is closed for good.
+func (c *Conn) dropSocket(ws Transport) {
+	ws.Close()
+	c.sockLock.Lock()
+	if c.session == nil || c.session.lost {
+		c.closed.Store(true)
+	}
+	c.sockLock.Unlock()
+}
+
+// loseSession stops the connection from being resumed, for when frames were
+// lost that a replay could not make up for.
+func (c *Conn) loseSession() {
+	c.sockLock.Lock()
+	if c.session != nil {
+		c.session.lost = true
+	}
+	c.sockLock.Unlock()
 }
 
 func (c *Conn) Send(ctx context.Context, cmd outcmds.Cmd, data interface{}) {
-	if c == nil || c.closed {
+	if c == nil || c.closed.Load() {
+		return
+	}
+	m, err := PrepareMessage(c.Codec(), cmd, data)
+	if logger.Check(err) {
+		return
+	}
+	c.SendFrame(ctx, NewFrame(cmd, m))
+}
+
+// SendKeyed sends data as a keyed frame, so it replaces any frame for the
+// same cmd and key that is still queued. See NewKeyedFrame.
+func (c *Conn) SendKeyed(ctx context.Context, cmd outcmds.Cmd, key string, data interface{}) {
+	if c == nil || c.closed.Load() {
 		return
 	}
-	m, err := PrepareJsonMessage(cmd, data)
+	m, err := PrepareMessage(c.Codec(), cmd, data)
 	if logger.Check(err) {
 		return
 	}
-	c.SendMessage(ctx, m)
+	c.SendFrame(ctx, NewKeyedFrame(cmd, key, m))
 }
 
 func (c *Conn) SendSync(ctx context.Context, cmd outcmds.Cmd, data interface{}) {
@@ -314,6 +487,9 @@ func (c *Conn) SendSync(ctx context.Context, cmd outcmds.Cmd, data interface{})
 
 const MaxJsonSize = 100000
 
+// PrepareJsonMessage prepares a message for SendMessage, which only
+// connections using the JSON codec take. A large message is offloaded for
+// any client to fetch. PrepareMessage works for every codec.
 func PrepareJsonMessage(cmd outcmds.Cmd, data interface{}) (*websocket.PreparedMessage, error) {
 	m := &Message{Cmd: cmd, Data: data}
 	b, err := json.Marshal(m)
@@ -327,44 +503,130 @@ func PrepareJsonMessage(cmd outcmds.Cmd, data interface{}) (*websocket.PreparedM
 	return websocket.NewPreparedMessage(websocket.TextMessage, b)
 }
 
+// PrepareMessage encodes a message with the given codec. The result can only
+// be sent to connections using that codec.
+func PrepareMessage(codec Codec, cmd outcmds.Cmd, data interface{}) (*PreparedMessage, error) {
+	return prepareEncoded(codec, &Message{Cmd: cmd, Data: data})
+}
+
+func prepareEncoded(codec Codec, m *Message) (*PreparedMessage, error) {
+	b, err := codec.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxJsonSize {
+		return &PreparedMessage{frameType: codec.FrameType(), large: &largeMessage{codec: codec, full: b}}, nil
+	}
+	return NewPreparedMessage(codec.FrameType(), b), nil
+}
+
 func (c *Conn) SendRaw(ctx context.Context, data *Message) {
-	if c == nil || c.closed {
-		return
+	if data.Id > 0 {
+		if suppressed(ctx, data) {
+			return
+		}
+		recordReply(ctx, data)
 	}
-	b, err := json.Marshal(data)
-	if logger.Check(err) {
+	if c == nil || c.closed.Load() {
 		return
 	}
-	if len(b) > MaxJsonSize {
-		id := AddMessage(b)
-		b = []byte(fmt.Sprintf(`{"httpid":"%s"}`, id.String()))
-	}
-	m, err := websocket.NewPreparedMessage(websocket.TextMessage, b)
+	m, err := prepareEncoded(c.Codec(), data)
 	if logger.Check(err) {
 		return
 	}
-	c.SendMessage(ctx, m)
+	c.SendFrame(ctx, NewFrame(data.Cmd, m))
 }
 
+// SendMessage queues a JSON message prepared by the websocket package, such
+// as by PrepareJsonMessage. Its payload cannot be read back or re-encoded, so
+// connections using another codec refuse it, and only websocket connections
+// write it; bots and in-memory transports skip it. SendPrepared takes
+// messages from PrepareMessage, which every connection can write.
 func (c *Conn) SendMessage(ctx context.Context, m *websocket.PreparedMessage) {
-	if c == nil || c.closed {
+	if codec := c.Codec(); codec != JSONCodec {
+		logger.Check(fmt.Errorf("a JSON message cannot be sent to a %s connection", codec.Name()))
+		return
+	}
+	c.SendPrepared(ctx, websocketPrepared(m))
+}
+
+// SendPrepared queues a prepared message with the default send policy. Use
+// SendFrame to give it a priority, coalescing key or expiry.
+func (c *Conn) SendPrepared(ctx context.Context, m *PreparedMessage) {
+	c.SendFrame(ctx, &Frame{Message: m, Priority: defaultSendPolicy.Priority})
+}
+
+// FetchKey is the key the client sends with HTTP requests for its offloaded
+// messages. It is sent to the client under outcmds.FetchKey.
+func (c *Conn) FetchKey() string {
+	if c == nil {
+		return ""
+	}
+	return c.fetchKey
+}
+
+func newFetchKey() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (c *Conn) SendFrame(ctx context.Context, f *Frame) {
+	if c == nil || c.closed.Load() {
+		return
+	}
+	if f.Message.large != nil && !c.sendLarge(f) {
 		return
 	}
-	if len(c.sendChan) == cap(c.sendChan) {
-		logger.CheckStack(errors.New("sendChan is full"))
+	c.push(f)
+}
+
+// push queues f, closing the connection if its outbox overflowed.
+func (c *Conn) push(f *Frame) bool {
+	if !c.out.push(f) {
+		logger.CheckStack(errors.New("outbox is full"))
+		c.loseSession()
 		c.Close()
-	} else {
-		c.sendChan <- m
+		return false
 	}
+	return true
 }
 
+// SendMessageSync writes m before returning rather than queueing it. It is
+// still numbered in the session history, so a resume replays it in order.
+// Large messages are queued as usual.
 func (c *Conn) SendMessageSync(ctx context.Context, m *Message) {
-	if c == nil || c.closed {
+	if c == nil || c.closed.Load() {
 		return
 	}
-	if !c.closed && logger.Check(c.conn.WriteJSON(m)) {
-		c.Close()
+	p, err := prepareEncoded(c.Codec(), m)
+	if logger.Check(err) {
+		return
+	}
+	if p.large != nil {
+		c.SendFrame(ctx, NewFrame(m.Cmd, p))
+		return
 	}
+	ws, _ := c.socket()
+	c.write(ws, p)
+}
+
+// write numbers m in the session history and writes it to ws, dropping the
+// socket if that fails. Frames are numbered before they are written, so a
+// frame whose write fails is still replayed on resume.
+func (c *Conn) write(ws Transport, m *PreparedMessage) bool {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.sockLock.Lock()
+	if c.session != nil {
+		c.session.history.add(m)
+	}
+	c.sockLock.Unlock()
+	if !c.closed.Load() && logger.Check(ws.WritePrepared(m)) {
+		c.dropSocket(ws)
+		return false
+	}
+	return true
 }
 
 func NewInfo(m string) *Info {
@@ -375,13 +637,19 @@ func (c *Conn) SendInfo(ctx context.Context, m string) {
 	if len(m) == 0 {
 		return
 	}
-	c.Send(ctx, outcmds.ChatMessage, &Info{Message: m})
+	SendTyped(ctx, c, ChatMessageCmd, &Info{Message: m})
 }
 
 func (uConn *UserConn) ListenRead(ctx context.Context) {
+	ws, gen := uConn.socket()
+	defer func() {
+		uConn.sockLock.Lock()
+		uConn.readerGen = gen
+		uConn.sockLock.Unlock()
+	}()
 	for {
 		m := &RawMessage{}
-		err := uConn.conn.ReadJSON(m)
+		_, b, err := ws.ReadMessage()
 		wsErr, ok := err.(*websocket.CloseError)
 		if ok && wsErr.Code == websocket.CloseGoingAway {
 			return
@@ -389,54 +657,62 @@ func (uConn *UserConn) ListenRead(ctx context.Context) {
 		if logger.Check(err) {
 			return
 		}
+		if logger.Check(decodeRawMessage(uConn.Codec(), b, m)) {
+			return
+		}
 
-		go uConn.handleMessage(ctx, m)
+		uConn.dispatch(ctx, m)
 		uConn.pingTimer.Reset(connectionTimeout / 2)
-		uConn.lastMessageReceived = time.Now()
+		uConn.lastMessageReceived.Store(time.Now().UnixNano())
 	}
 }
 
 func (uConn *UserConn) handleMessage(ctx context.Context, m *RawMessage) {
-	defer func() {
-		if r := recover(); r != nil {
-			message := fmt.Sprintf("Panic serving %s: %v", uConn.PrintName(), r)
-			logger.CheckStack(errors.New(message))
-			uConn.SendInfo(ctx, "Something went wrong...")
+	if req := m.req; req != nil {
+		defer uConn.running.remove(req)
+		var cancel context.CancelFunc
+		var ok bool
+		ctx, cancel, ok = req.start(ctx)
+		defer cancel()
+		if !ok {
+			return
 		}
-	}()
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
-	uConn.router.ServeWS(ctx, uConn, m)
-	cancel()
+	}
+	chain(uConn.router, DefaultMiddleware).ServeWS(ctx, uConn, m)
 }
 
-var pingMessage, _ = websocket.NewPreparedMessage(websocket.PingMessage, []byte("keepalive"))
+var pingMessage = []byte("keepalive")
 
-func (c *Conn) listenWrite(ctx context.Context) {
-	c.conn.SetPongHandler(func(msg string) error {
-		c.lastMessageReceived = time.Now()
+func (c *Conn) listenWrite(ctx context.Context, ws Transport) {
+	ws.SetPongHandler(func(msg string) error {
+		c.lastMessageReceived.Store(time.Now().UnixNano())
 		return nil
 	})
 
 	done := ctx.Done()
 	for {
-		if time.Since(c.lastMessageReceived) > connectionTimeout {
+		if time.Since(time.Unix(0, c.lastMessageReceived.Load())) > connectionTimeout {
 			log.Println("Connection closed for missed pong")
-			c.Close()
+			c.dropSocket(ws)
 			return
 		}
 		select {
 		case <-c.pingTimer.C:
-			err := c.conn.WritePreparedMessage(pingMessage)
+			err := ws.WriteControl(websocket.PingMessage, pingMessage, time.Now().Add(connectionTimeout))
 			if err != nil {
-				c.Close()
+				c.dropSocket(ws)
 				if err.Error() != "websocket: close sent" {
 					log.Println("Connection closed for ping error:", err)
 				}
 				return
 			}
-		case m := <-c.sendChan:
-			if !c.closed && logger.Check(c.conn.WritePreparedMessage(m)) {
-				c.Close()
+		case <-c.out.ready:
+			m := c.out.pop(time.Now())
+			if m == nil {
+				continue
+			}
+			if !c.write(ws, m) {
+				return
 			}
 			continue
 		case <-done:
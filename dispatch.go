@@ -0,0 +1,90 @@
+package qws
+
+import (
+	"context"
+	"sync"
+)
+
+// MaxInFlight bounds how many handlers can run at once for one connection.
+// Only routes registered with Concurrent can take more than one slot.
+var MaxInFlight = 8
+
+// inboundQueue is how many read messages can wait for a handler before
+// ListenRead stops reading from the socket.
+const inboundQueue = 64
+
+// dispatcher hands a connection's messages to its router in the order they
+// were read. It outlives any one socket, so messages queued before a session
+// is resumed are still handled after it.
+type dispatcher struct {
+	start  sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan *RawMessage
+	slots  chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		queue: make(chan *RawMessage, inboundQueue),
+		slots: make(chan struct{}, MaxInFlight),
+	}
+}
+
+// dispatch queues m for handling, starting the dispatcher on first use. The
+// handlers' context keeps the values of ctx but is only cancelled when the
+// connection closes, along with uConn.Context.
+func (uConn *UserConn) dispatch(ctx context.Context, m *RawMessage) {
+	if uConn.handleReply(m) || uConn.handleCancel(m) || uConn.handleChunk(ctx, m) {
+		return
+	}
+	if m.Id > 0 {
+		uConn.running.add(uConn, m)
+	}
+	d := uConn.inbound
+	d.start.Do(func() {
+		d.ctx, d.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		go d.run(uConn)
+	})
+	select {
+	case d.queue <- m:
+	case <-d.ctx.Done():
+	}
+}
+
+func (d *dispatcher) run(uConn *UserConn) {
+	done := d.ctx.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case m := <-d.queue:
+			select {
+			case d.slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			if uConn.router.isConcurrent(m.Cmd) {
+				go func() {
+					defer d.release()
+					uConn.handleMessage(d.ctx, m)
+				}()
+			} else {
+				uConn.handleMessage(d.ctx, m)
+				d.release()
+			}
+		}
+	}
+}
+
+func (d *dispatcher) release() {
+	<-d.slots
+}
+
+// stop cancels every running handler and drops anything still queued.
+func (d *dispatcher) stop() {
+	d.start.Do(func() {
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+	})
+	d.cancel()
+}
@@ -0,0 +1,95 @@
+package qws
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func newDispatchTestConn() *UserConn {
+	return &UserConn{user: &User{Name: "Somebody"}, router: NewRouter(), inbound: newDispatcher()}
+}
+
+func TestDispatchHandlesMessagesInOrder(t *testing.T) {
+	c := newDispatchTestConn()
+	var lock sync.Mutex
+	var order []incmds.Cmd
+	done := make(chan struct{})
+	record := func(ctx context.Context, _ *UserConn, m *RawMessage) {
+		if m.Cmd == incmds.Moves {
+			// Give a later message every chance to overtake this one.
+			time.Sleep(20 * time.Millisecond)
+		}
+		lock.Lock()
+		order = append(order, m.Cmd)
+		if len(order) == 3 {
+			close(done)
+		}
+		lock.Unlock()
+	}
+	c.router.HandleFunc(incmds.Moves, record)
+	c.router.HandleFunc(incmds.Ready, record)
+	c.router.HandleFunc(incmds.Shots, record)
+
+	ctx := t.Context()
+	c.dispatch(ctx, &RawMessage{Cmd: incmds.Moves})
+	c.dispatch(ctx, &RawMessage{Cmd: incmds.Shots})
+	c.dispatch(ctx, &RawMessage{Cmd: incmds.Ready})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("messages were not handled")
+	}
+	if order[0] != incmds.Moves || order[1] != incmds.Shots || order[2] != incmds.Ready {
+		t.Fatalf("handled out of order: %v", order)
+	}
+}
+
+func TestDispatchRunsConcurrentRoutesTogether(t *testing.T) {
+	c := newDispatchTestConn()
+	var started sync.WaitGroup
+	started.Add(2)
+	both := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(both)
+	}()
+	wait := func(ctx context.Context, _ *UserConn, m *RawMessage) {
+		started.Done()
+		<-both
+	}
+	c.router.HandleFunc(incmds.MapList, wait, Concurrent())
+	c.router.HandleFunc(incmds.StatsTop, wait, Concurrent())
+
+	c.dispatch(t.Context(), &RawMessage{Cmd: incmds.MapList})
+	c.dispatch(t.Context(), &RawMessage{Cmd: incmds.StatsTop})
+	select {
+	case <-both:
+	case <-time.After(time.Second):
+		t.Fatal("concurrent routes did not run at the same time")
+	}
+}
+
+func TestDispatchStopCancelsRunningHandlers(t *testing.T) {
+	c := newDispatchTestConn()
+	running := make(chan struct{})
+	cancelled := make(chan struct{})
+	c.router.HandleFunc(incmds.MatchData, func(ctx context.Context, _ *UserConn, m *RawMessage) {
+		close(running)
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	c.dispatch(t.Context(), &RawMessage{Cmd: incmds.MatchData})
+	<-running
+	c.inbound.stop()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("closing the connection did not cancel its handler")
+	}
+}
@@ -2,29 +2,28 @@ package qws
 
 import (
 	"context"
-	"encoding/json"
 	"log"
+	"reflect"
+	"sync"
 
 	"github.com/amh11706/logger"
+	"github.com/amh11706/qws/incmds"
 )
 
 type DynamicFunc[In any, Out any] func(context.Context, UserConner, In) Out
 
+// DynamicErrFunc is a DynamicFunc that can fail. A non-nil error is sent in
+// place of Out, see Error.
+type DynamicErrFunc[In any, Out any] func(context.Context, UserConner, In) (Out, error)
+
 type DynamicHandler[T any, R any] struct {
 	f DynamicFunc[T, R]
 }
 
 func (h *DynamicHandler[T, R]) ServeWS(ctx context.Context, c *UserConn, m *RawMessage) {
-	in := new(T)
-	if len(m.Data) > 0 {
-		err := json.Unmarshal(m.Data, in)
-		if logger.Check(err) {
-			log.Printf(
-				"\x1b[36m%s\x1b[0m invalid ws parameter for cmd %d: %v\n",
-				c.PrintName(), m.Cmd, string(m.Data),
-			)
-			return
-		}
+	in, ok := decodeDynamic[T](ctx, c, m)
+	if !ok {
+		return
 	}
 	out := h.f(ctx, c, *in)
 
@@ -37,6 +36,101 @@ func (h *DynamicHandler[T, R]) ServeWS(ctx context.Context, c *UserConn, m *RawM
 }
 
 func NewDynamicHandler[T any, R any](f DynamicFunc[T, R]) *DynamicHandler[T, R] {
+	checkRules(reflect.TypeFor[T]())
 	h := &DynamicHandler[T, R]{f: f}
 	return h
 }
+
+type DynamicErrHandler[T any, R any] struct {
+	f DynamicErrFunc[T, R]
+}
+
+func (h *DynamicErrHandler[T, R]) ServeWS(ctx context.Context, c *UserConn, m *RawMessage) {
+	in, ok := decodeDynamic[T](ctx, c, m)
+	if !ok {
+		return
+	}
+	out, err := h.f(ctx, c, *in)
+	if err != nil {
+		c.SendError(ctx, m.Id, err)
+		m.Id = 0
+		return
+	}
+
+	if m.Id > 0 {
+		c.SendRaw(ctx, &Message{Id: m.Id, Data: out})
+		m.Id = 0
+	} else if outStr, ok := any(out).(string); ok {
+		c.SendInfo(ctx, outStr)
+	}
+}
+
+func NewDynamicErrHandler[T any, R any](f DynamicErrFunc[T, R]) *DynamicErrHandler[T, R] {
+	checkRules(reflect.TypeFor[T]())
+	return &DynamicErrHandler[T, R]{f: f}
+}
+
+// decodeDynamic unmarshals the data of m and validates it. If it cannot, the
+// failure is logged and sent as the reply to m when it has an Id.
+func decodeDynamic[T any](ctx context.Context, c *UserConn, m *RawMessage) (*T, bool) {
+	in := new(T)
+	if len(m.Data) > 0 {
+		err := unmarshalInput(m.Data, in, isStrict(ctx))
+		if logger.Check(err) {
+			log.Printf(
+				"\x1b[36m%s\x1b[0m invalid ws parameter for cmd %d: %v\n",
+				c.PrintName(), m.Cmd, string(m.Data),
+			)
+			if m.Id > 0 {
+				c.SendError(ctx, m.Id, NewError(CodeBadRequest, "Invalid request data.").WithDetails(err.Error()))
+				m.Id = 0
+			}
+			return nil, false
+		}
+	}
+	if err := validateInput(in); err != nil {
+		log.Printf("\x1b[36m%s\x1b[0m rejected cmd %d: %v\n", c.PrintName(), m.Cmd, err)
+		if m.Id > 0 {
+			c.SendError(ctx, m.Id, err)
+			m.Id = 0
+		}
+		return nil, false
+	}
+	return in, true
+}
+
+// DynamicRoute is a command registered with HandleDynamic or
+// HandleDynamicErr, with the type it decodes and the type it replies with.
+type DynamicRoute struct {
+	Cmd incmds.Cmd
+	In  reflect.Type
+	Out reflect.Type
+}
+
+var dynamicRoutes struct {
+	lock sync.Mutex
+	seen map[DynamicRoute]bool
+	list []DynamicRoute
+}
+
+func recordDynamicRoute(rt DynamicRoute) {
+	dynamicRoutes.lock.Lock()
+	defer dynamicRoutes.lock.Unlock()
+	if dynamicRoutes.seen[rt] {
+		return
+	}
+	if dynamicRoutes.seen == nil {
+		dynamicRoutes.seen = make(map[DynamicRoute]bool)
+	}
+	dynamicRoutes.seen[rt] = true
+	dynamicRoutes.list = append(dynamicRoutes.list, rt)
+}
+
+// DynamicRoutes returns every distinct route registered with HandleDynamic or
+// HandleDynamicErr in this process, on any router, in the order they were
+// first registered.
+func DynamicRoutes() []DynamicRoute {
+	dynamicRoutes.lock.Lock()
+	defer dynamicRoutes.lock.Unlock()
+	return append([]DynamicRoute(nil), dynamicRoutes.list...)
+}
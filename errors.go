@@ -0,0 +1,59 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Codes for Error, so clients can tell failures apart without matching on
+// the message.
+const (
+	CodeBadRequest = "bad_request"
+	CodeDenied     = "denied"
+	CodeNotFound   = "not_found"
+	CodeInternal   = "internal"
+)
+
+// Error is a failure reported to the client in the reply to its request. Its
+// message is shown to the user, so handlers should only return errors of this
+// type for things the user can see. Any other error is logged and reported as
+// CodeInternal.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	cp := *e
+	cp.Details = details
+	return &cp
+}
+
+// errInternal is what the client is told about errors that are not an Error.
+var errInternal = &Error{Code: CodeInternal, Message: "Something went wrong, please try again."}
+
+// SendError tells the client about err: as the reply to id when it is not 0,
+// or as an info message otherwise.
+func (c *UserConn) SendError(ctx context.Context, id uint32, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		log.Printf("\x1b[36m%s\x1b[0m handler failed: %v\n", c.PrintName(), err)
+		e = errInternal
+	}
+	if id > 0 {
+		c.SendRaw(ctx, &Message{Id: id, Error: e})
+	} else {
+		c.SendInfo(ctx, e.Message)
+	}
+}
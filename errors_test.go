@@ -0,0 +1,62 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestDynamicErrHandlerRepliesWithError(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	replies := b.Subscribe(0, 4)
+	b.Start(t.Context())
+	defer b.Close()
+
+	r := NewRouter()
+	HandleDynamicErr(r, incmds.MapGet, func(ctx context.Context, c UserConner, id int) (string, error) {
+		switch id {
+		case 1:
+			return "", nil
+		case 2:
+			return "", NewError(CodeNotFound, "No such map.").WithDetails(id)
+		}
+		return "", errors.New("db down")
+	})
+
+	expect := func(id uint32) *ClientMessage {
+		t.Helper()
+		select {
+		case m := <-replies:
+			if m.Id != id {
+				t.Fatalf("got reply to %d, want %d", m.Id, id)
+			}
+			return m
+		case <-time.After(time.Second):
+			t.Fatalf("no reply to %d", id)
+		}
+		return nil
+	}
+
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapGet, Id: 1, Data: []byte(`1`)})
+	if m := expect(1); m.Error != nil || string(m.Data) != `""` {
+		t.Fatalf("empty result came back as %s, %+v", m.Data, m.Error)
+	}
+
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapGet, Id: 2, Data: []byte(`2`)})
+	if e := expect(2).Error; e == nil || e.Code != CodeNotFound || e.Details != 2.0 {
+		t.Fatalf("typed error came back as %+v", e)
+	}
+
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapGet, Id: 3, Data: []byte(`3`)})
+	if e := expect(3).Error; e == nil || e.Code != CodeInternal || e.Message == "db down" {
+		t.Fatalf("plain error came back as %+v", e)
+	}
+
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapGet, Id: 4, Data: []byte(`"one"`)})
+	if e := expect(4).Error; e == nil || e.Code != CodeBadRequest {
+		t.Fatalf("bad data came back as %+v", e)
+	}
+}
@@ -12,12 +12,16 @@ require (
 	github.com/amh11706/logger v0.0.0-20240228210936-9df6d23b8ea9
 	github.com/amh11706/qdb v0.0.0-20201108153937-e79024dfa7f6
 	github.com/amh11706/qsql v0.0.0-20220123094420-b9b581d9642f
+	github.com/fxamacker/cbor/v2 v2.9.4
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
 )
 
 require (
 	github.com/go-sql-driver/mysql v1.7.1 // indirect
 	github.com/jmoiron/sqlx v1.3.5 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.17.0 // indirect
 )
@@ -1,43 +1,100 @@
 package qws
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/amh11706/logger"
 	"github.com/google/uuid"
 )
 
-// large websocket messages can cause issues for some clients,
-// so we convert larger messages to an http request
+// offloadContentTypes maps codec names to the Content-Type of their messages.
+var offloadContentTypes = map[string]string{
+	JSONCodec.Name():    "application/json",
+	MsgpackCodec.Name(): "application/vnd.msgpack",
+	CBORCodec.Name():    "application/cbor",
+}
 
-var messageMap = make(map[uuid.UUID][]byte)
-var messageLock = make(chan struct{}, 1)
+func offloadContentType(codec Codec) string {
+	if t, ok := offloadContentTypes[codec.Name()]; ok {
+		return t
+	}
+	return "application/octet-stream"
+}
 
+// AddMessage stores msg for one read by anyone who has the returned id.
 func AddMessage(msg []byte) uuid.UUID {
-	messageLock <- struct{}{}
-	defer func() { <-messageLock }()
-	id := uuid.New()
-	messageMap[id] = msg
-	time.AfterFunc(5*time.Second, func() {
-		messageLock <- struct{}{}
-		defer func() { <-messageLock }()
-		delete(messageMap, id)
-	})
+	id, err := Offloads.Add(msg, offloadContentType(JSONCodec))
+	if logger.Check(err) {
+		return uuid.Nil
+	}
+	Offloads.Grant(id, "")
 	return id
 }
 
+// GetMessage uses the read AddMessage granted of a stored message.
 func GetMessage(id uuid.UUID) []byte {
-	messageLock <- struct{}{}
-	defer func() { <-messageLock }()
-	msg, exists := messageMap[id]
-	if exists {
-		delete(messageMap, id)
+	m, err := Offloads.Get(context.Background(), id, "")
+	if err != nil {
+		return nil
 	}
-	return msg
+	return m.Data
+}
+
+// The fetch key can be sent in a header or, for clients that cannot set
+// headers on the request, a cookie.
+const (
+	FetchKeyHeader = "X-Qws-Fetch-Key"
+	FetchKeyCookie = "qws_fetch_key"
+)
+
+// OffloadHandler serves offloaded messages to the connections they were sent
+// to. The last element of the path is the message id.
+type OffloadHandler struct {
+	// Store defaults to Offloads.
+	Store OffloadStore
+	// IPHeader names a header a trusted proxy puts the client address in.
+	IPHeader string
+	// PerSecond and Burst rate limit fetches from one address. Zero
+	// PerSecond leaves fetches unlimited.
+	PerSecond float64
+	Burst     float64
+	// MinGzipSize is the smallest message worth compressing.
+	MinGzipSize int
+
+	limiter ipLimiter
 }
 
+var defaultOffloadHandler = &OffloadHandler{MinGzipSize: 1024}
+
+// HandleHttpMessage serves offloaded messages with the default settings,
+// which do not rate limit; serve a configured OffloadHandler for that.
 func HandleHttpMessage(w http.ResponseWriter, r *http.Request) {
+	defaultOffloadHandler.ServeHTTP(w, r)
+}
+
+func (h *OffloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	store := h.Store
+	if store == nil {
+		store = Offloads
+	}
+	ctx := r.Context()
+	if ps, ok := store.(*PeerOffloadStore); ok && ps.isPeer(r) {
+		// A node passes on the fetches of all its clients, so it is not
+		// limited like one of them.
+		ctx = fromPeer(ctx)
+	} else if !h.limiter.allow(clientIP(r, h.IPHeader), time.Now(), h.PerSecond, h.Burst) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
 	lastSlash := strings.LastIndex(r.URL.Path, "/")
 	if lastSlash == -1 || lastSlash == len(r.URL.Path)-1 {
 		http.Error(w, "Invalid message ID", http.StatusBadRequest)
@@ -48,10 +105,175 @@ func HandleHttpMessage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid message ID", http.StatusBadRequest)
 		return
 	}
-	msg := GetMessage(id)
-	if msg == nil {
+	key := r.Header.Get(FetchKeyHeader)
+	if key == "" {
+		if c, err := r.Cookie(FetchKeyCookie); err == nil {
+			key = c.Value
+		}
+	}
+	m, err := store.Get(ctx, id, key)
+	if errors.Is(err, ErrOffloadNotFound) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
-	w.Write(msg)
+	if logger.Check(err) {
+		http.Error(w, "Message unavailable", http.StatusBadGateway)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", m.ContentType)
+	// Each read is granted to one connection once, so nothing may keep it.
+	header.Set("Cache-Control", "private, no-store")
+	header.Set("Vary", "Accept-Encoding, "+FetchKeyHeader+", Cookie")
+	body := m.Data
+	if len(body) >= h.MinGzipSize && acceptsGzip(r) {
+		if gz := m.gzip(); gz != nil {
+			header.Set("Content-Encoding", "gzip")
+			body = gz
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip. There
+// is no brotli encoder in the standard library, so br is not offered.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		v, err := strconv.ParseFloat(q, 64)
+		return err == nil && v > 0
+	}
+	return false
+}
+
+// ipLimiter is a token bucket per client address. Buckets that have filled
+// back up are dropped when the map is swept.
+type ipLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*ipBucket
+	lastSweep time.Time
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *ipLimiter) allow(ip string, now time.Time, perSecond, burst float64) bool {
+	if perSecond <= 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*ipBucket)
+	}
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond >= burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b := l.buckets[ip]
+	if b == nil {
+		b = &ipBucket{tokens: burst}
+		l.buckets[ip] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * perSecond
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientIP is the address of the client of r, taken from header when a
+// trusted proxy sets it.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if h := r.Header.Get(header); h != "" {
+			first, _, _ := strings.Cut(h, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RoutesHandler dumps the routing table of a live connection, named by the
+// sid query parameter, as JSON. The caller authenticates with its login token
+// as a bearer token and must be at least MinAdmin.
+type RoutesHandler struct {
+	Server *Server
+	// MinAdmin defaults to AdminLevelAdmin.
+	MinAdmin AdminLevel
+}
+
+// ConnRoutes is what RoutesHandler writes.
+type ConnRoutes struct {
+	SId      int64       `json:"sid"`
+	User     string      `json:"user"`
+	Routes   []RouteInfo `json:"routes"`
+	Commands []string    `json:"commands,omitempty"`
+}
+
+func (h *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.Server.Auth.Authenticate(r.Context(), &LoginFrame{Token: token})
+	if err != nil || user == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	minAdmin := h.MinAdmin
+	if minAdmin == AdminLevelUser {
+		minAdmin = AdminLevelAdmin
+	}
+	if user.AdminLvl < minAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	sid, err := strconv.ParseInt(r.URL.Query().Get("sid"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid sid", http.StatusBadRequest)
+		return
+	}
+	c := h.Server.Conn(sid)
+	if c == nil {
+		http.Error(w, "No such connection", http.StatusNotFound)
+		return
+	}
+	dump := &ConnRoutes{SId: c.SId, User: c.PrintName(), Routes: c.Router().Routes()}
+	if cmds := c.CmdRouter(); cmds != nil {
+		info := RouteInfo{}
+		describe(cmds, &info, nil)
+		dump.Commands = info.Commands
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	logger.Check(json.NewEncoder(w).Encode(dump))
 }
@@ -0,0 +1,116 @@
+package qws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+	"github.com/google/uuid"
+)
+
+func TestOffloadHandlerChecksKeyAndCompresses(t *testing.T) {
+	s := NewMemoryOffloadStore(time.Minute, 1<<20)
+	h := &OffloadHandler{Store: s, MinGzipSize: 10}
+	msg := bytes.Repeat([]byte("a"), 100)
+	id, _ := s.Add(msg, "application/cbor")
+	s.Grant(id, "key")
+
+	get := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/msg/"+id.String(), nil)
+		r.Header.Set("Accept-Encoding", "br;q=1, gzip;q=0.5")
+		if key != "" {
+			r.AddCookie(&http.Cookie{Name: FetchKeyCookie, Value: key})
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("other"); w.Code != http.StatusNotFound {
+		t.Fatalf("wrong key got %d", w.Code)
+	}
+	w := get("key")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/cbor" ||
+		w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Cache-Control") != "private, no-store" {
+		t.Fatalf("got %d with headers %v", w.Code, w.Header())
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(zr); err != nil || !bytes.Equal(body, msg) {
+		t.Fatalf("body = %q, %v", body, err)
+	}
+}
+
+func TestOffloadHandlerLimitsEachAddress(t *testing.T) {
+	h := &OffloadHandler{Store: NewMemoryOffloadStore(time.Minute, 1<<20), PerSecond: 1, Burst: 2}
+	codes := []int{}
+	for _, addr := range []string{"1.1.1.1:1", "1.1.1.1:2", "1.1.1.1:3", "2.2.2.2:1"} {
+		r := httptest.NewRequest(http.MethodGet, "/msg/"+uuid.NewString(), nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	want := []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests, http.StatusNotFound}
+	if !slices.Equal(codes, want) {
+		t.Fatalf("got %v, want %v", codes, want)
+	}
+}
+
+func TestHandleHttpMessageIsNotLimited(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/msg/"+uuid.NewString(), nil)
+		w := httptest.NewRecorder()
+		HandleHttpMessage(w, r)
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d was rate limited", i)
+		}
+	}
+}
+
+func TestRoutesHandlerIsAdminOnly(t *testing.T) {
+	auth := NewMemoryAuthenticator()
+	auth.Add("admin", &User{Id: 1, Name: "Admin", AdminLvl: AdminLevelAdmin})
+	auth.Add("mod", &User{Id: 2, Name: "Mod", AdminLvl: AdminLevelMod})
+	s := NewServer(auth)
+	b := NewBotConn(7, &User{Name: "Bot"})
+	b.Router().HandleFunc(incmds.StatsTop, func(ctx context.Context, c *UserConn, m *RawMessage) {})
+	s.conns[b.SId] = b.UserConn
+	h := &RoutesHandler{Server: s}
+
+	get := func(token, sid string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/debug/routes?sid="+sid, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("", "7"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token got %d", w.Code)
+	}
+	if w := get("mod", "7"); w.Code != http.StatusForbidden {
+		t.Fatalf("mod got %d", w.Code)
+	}
+	if w := get("admin", "8"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown sid got %d", w.Code)
+	}
+	w := get("admin", "7")
+	var dump ConnRoutes
+	if err := json.Unmarshal(w.Body.Bytes(), &dump); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d %s: %v", w.Code, w.Body, err)
+	}
+	if dump.SId != 7 || len(dump.Routes) != 1 || dump.Routes[0].Cmd != incmds.StatsTop || dump.Routes[0].Kind != KindFunc {
+		t.Fatalf("dumped %+v", dump)
+	}
+}
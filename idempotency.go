@@ -0,0 +1,175 @@
+package qws
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+// Idempotent makes the route handle each request Id from a session once.
+// A request repeated within window of the first one finishing is answered
+// with the first one's reply without running the handler again, and one
+// repeated while the first is still running is dropped, as the first will
+// answer it. Sessions survive resuming after a reconnect, so retries made
+// from the resumed socket are recognised. Messages without an Id are
+// always handled.
+func Idempotent(window time.Duration) RouteOption {
+	return func(r *route) {
+		r.idem = newIdempotency(window, false)
+	}
+}
+
+// IdempotentPerUser is Idempotent for clients that log in again rather than
+// resume, and so need their Ids matched by user rather than by session. A
+// user's requests are remembered across all of their connections, whichever
+// Router the route is registered on, so a retry from a new login or a second
+// tab is recognised. The client must not reuse Ids across its logins within
+// window. Guests are still matched by session.
+func IdempotentPerUser(window time.Duration) RouteOption {
+	return func(r *route) {
+		r.idem = newIdempotency(window, true)
+	}
+}
+
+type requestKey struct {
+	user int64
+	sid  int64
+	cmd  incmds.Cmd
+	id   uint32
+}
+
+type handledRequest struct {
+	done    bool
+	reply   *Message
+	expires time.Time
+}
+
+type idempotency struct {
+	window  time.Duration
+	perUser bool
+	// store holds the requests matched by session, which only ever reach
+	// the route they were made to.
+	store *requestStore
+}
+
+// requestStore holds the requests of one or more idempotent routes.
+type requestStore struct {
+	lock      sync.Mutex
+	requests  map[requestKey]*handledRequest
+	nextSweep time.Time
+}
+
+// userRequests is shared by every IdempotentPerUser route, since the same
+// user's connections each have their own routes.
+var userRequests = newRequestStore()
+
+func newRequestStore() *requestStore {
+	return &requestStore{requests: make(map[requestKey]*handledRequest)}
+}
+
+func newIdempotency(window time.Duration, perUser bool) *idempotency {
+	return &idempotency{window: window, perUser: perUser, store: newRequestStore()}
+}
+
+// storeFor returns where c's request m is remembered, and under what key.
+func (p *idempotency) storeFor(c *UserConn, m *RawMessage) (*requestStore, requestKey) {
+	if p.perUser && !c.IsGuest() {
+		return userRequests, requestKey{user: c.UserId(), cmd: m.Cmd, id: m.Id}
+	}
+	return p.store, requestKey{sid: c.SId, cmd: m.Cmd, id: m.Id}
+}
+
+// guard wraps h so repeated requests are replayed or dropped.
+func (p *idempotency) guard(h Handler) Handler {
+	if p == nil {
+		return h
+	}
+	return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+		if m.Id == 0 {
+			h.ServeWS(ctx, c, m)
+			return
+		}
+		store, key := p.storeFor(c, m)
+		now := time.Now()
+		store.lock.Lock()
+		store.sweep(now, p.window)
+		if req := store.requests[key]; req != nil && !(req.done && now.After(req.expires)) {
+			done, reply := req.done, req.reply
+			store.lock.Unlock()
+			if done {
+				c.SendRaw(ctx, reply)
+			} else {
+				log.Printf("\x1b[36m%s\x1b[0m dropped repeat of cmd %d id %d while it runs\n", c.PrintName(), m.Cmd, m.Id)
+			}
+			m.Id = 0
+			return
+		}
+		req := &handledRequest{}
+		store.requests[key] = req
+		store.lock.Unlock()
+
+		rec := &replyRecorder{id: m.Id}
+		returned := false
+		defer func() {
+			// A request whose handler panicked, ran out of time, was
+			// cancelled or did not reply is run again when it is retried.
+			reply := rec.reply()
+			store.lock.Lock()
+			if returned && reply != nil && ctx.Err() == nil {
+				req.done, req.reply, req.expires = true, reply, time.Now().Add(p.window)
+			} else if store.requests[key] == req {
+				delete(store.requests, key)
+			}
+			store.lock.Unlock()
+		}()
+		h.ServeWS(context.WithValue(ctx, replyRecorderKey{}, rec), c, m)
+		returned = true
+	})
+}
+
+// sweep forgets requests whose window has passed, at most once a window.
+func (s *requestStore) sweep(now time.Time, window time.Duration) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	s.nextSweep = now.Add(window)
+	for key, req := range s.requests {
+		if req.done && now.After(req.expires) {
+			delete(s.requests, key)
+		}
+	}
+}
+
+// replyRecorder keeps the reply a handler sends for the request with id.
+type replyRecorder struct {
+	id   uint32
+	lock sync.Mutex
+	sent *Message
+}
+
+type replyRecorderKey struct{}
+
+func (r *replyRecorder) reply() *Message {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.sent
+}
+
+// recordReply hands m to the replyRecorder in ctx if m answers its request.
+// Replies have no Cmd; a request the handler makes with UserConn.Request
+// has one, and its Id is not the client's. A reply sent once ctx is done is
+// not kept, as it may be the handler giving up.
+func recordReply(ctx context.Context, m *Message) {
+	rec, _ := ctx.Value(replyRecorderKey{}).(*replyRecorder)
+	if rec == nil || m.Cmd != 0 || m.Id != rec.id || m.More || ctx.Err() != nil {
+		return
+	}
+	rec.lock.Lock()
+	if rec.sent == nil {
+		rec.sent = m
+	}
+	rec.lock.Unlock()
+}
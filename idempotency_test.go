@@ -0,0 +1,155 @@
+package qws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+)
+
+func TestIdempotentReplaysReply(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	replies := b.Subscribe(0, 4)
+	b.Start(t.Context())
+	defer b.Close()
+
+	runs := 0
+	r := NewRouter()
+	HandleDynamic(r, incmds.Bid, func(ctx context.Context, c UserConner, bid int) int {
+		runs++
+		return bid * runs
+	}, Idempotent(time.Minute))
+
+	for i := 0; i < 2; i++ {
+		r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.Bid, Id: 4, Data: []byte(`5`)})
+		select {
+		case m := <-replies:
+			var got int
+			if err := json.Unmarshal(m.Data, &got); err != nil || m.Id != 4 || got != 5 {
+				t.Fatalf("reply %d was %s, %v", m.Id, m.Data, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("repeated request got no reply")
+		}
+	}
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.Bid, Id: 5, Data: []byte(`5`)})
+	<-replies
+	if runs != 2 {
+		t.Fatalf("handler ran %d times, want once per Id", runs)
+	}
+}
+
+func TestIdempotentDropsRepeatsInFlight(t *testing.T) {
+	c := &UserConn{SId: 3, user: &User{Name: "Somebody"}}
+	started, release := make(chan struct{}), make(chan struct{})
+	runs := 0
+	r := NewRouter()
+	r.HandleFunc(incmds.MapSave, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		runs++
+		close(started)
+		<-release
+	}, Idempotent(time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeWS(t.Context(), c, &RawMessage{Cmd: incmds.MapSave, Id: 1})
+		close(done)
+	}()
+	<-started
+	repeat := &RawMessage{Cmd: incmds.MapSave, Id: 1}
+	r.ServeWS(t.Context(), c, repeat)
+	if repeat.Id != 0 {
+		t.Fatal("repeat in flight was not dropped")
+	}
+	close(release)
+	<-done
+
+	time.Sleep(5 * time.Millisecond)
+	started = make(chan struct{})
+	r.ServeWS(t.Context(), c, &RawMessage{Cmd: incmds.MapSave, Id: 1})
+	if runs != 2 {
+		t.Fatalf("handler ran %d times, want again once the window passed", runs)
+	}
+}
+
+func TestIdempotentIgnoresServerRequestsWithTheSameId(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	replies := b.Subscribe(0, 4)
+	b.Start(t.Context())
+	defer b.Close()
+
+	r := NewRouter()
+	r.HandleFunc(incmds.MapSave, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		c.SendRaw(ctx, &Message{Cmd: outcmds.Sync, Id: m.Id})
+	}, Idempotent(time.Minute))
+
+	for i := 0; i < 2; i++ {
+		r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapSave, Id: 1})
+		select {
+		case m := <-replies:
+			if m.Cmd != 0 || m.Id != 1 {
+				t.Fatalf("reply was cmd %d id %d", m.Cmd, m.Id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("request got no reply")
+		}
+	}
+}
+
+func TestIdempotentRunsAgainAfterPanic(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	replies := b.Subscribe(0, 4)
+	b.Start(t.Context())
+	defer b.Close()
+
+	runs := 0
+	r := NewRouter()
+	r.HandleFunc(incmds.MapSave, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		runs++
+		if runs == 1 {
+			panic("first try")
+		}
+		c.SendRaw(ctx, &Message{Id: m.Id, Data: runs})
+	}, Idempotent(time.Minute))
+
+	func() {
+		defer func() { recover() }()
+		r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapSave, Id: 1})
+	}()
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapSave, Id: 1})
+	select {
+	case m := <-replies:
+		var got int
+		if err := json.Unmarshal(m.Data, &got); err != nil || m.Id != 1 || got != 2 {
+			t.Fatalf("reply %d was %s, %v", m.Id, m.Data, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retry got no reply")
+	}
+	if runs != 2 {
+		t.Fatalf("handler ran %d times, want the retry to run it", runs)
+	}
+}
+
+func TestIdempotentPerUserMatchesAcrossConnections(t *testing.T) {
+	defer func(old *requestStore) { userRequests = old }(userRequests)
+	userRequests = newRequestStore()
+	user := &User{Id: 9, Name: "Somebody"}
+	runs := 0
+	for sid := int64(1); sid <= 2; sid++ {
+		// Each connection registers its own routes, as a login does.
+		c := &UserConn{SId: sid, user: user}
+		r := NewRouter()
+		r.HandleFunc(incmds.MapSave, func(ctx context.Context, c *UserConn, m *RawMessage) {
+			runs++
+			c.SendRaw(ctx, &Message{Id: m.Id})
+		}, IdempotentPerUser(time.Minute))
+		r.ServeWS(t.Context(), c, &RawMessage{Cmd: incmds.MapSave, Id: 77})
+	}
+	if runs != 1 {
+		t.Fatalf("handler ran %d times, want once for the user", runs)
+	}
+}
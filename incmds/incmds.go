@@ -50,6 +50,16 @@ const (
 	LeaveQueue
 	RateMap
 	GetBotMatch
+
+	// Reply answers a request the server made with UserConn.Request. Its Id
+	// is the one the request was sent with.
+	Reply
+	// Chunk carries part of a message too large to send in one frame, see
+	// qws.Chunk.
+	Chunk
+	// Cancel stops the request the client sent with the same Id. Its reply is
+	// not sent.
+	Cancel
 )
 
 const (
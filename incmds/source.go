@@ -0,0 +1,9 @@
+package incmds
+
+import _ "embed"
+
+// Source is the Go source declaring the commands. Generators read the command
+// names from it, since they are not available at run time.
+//
+//go:embed incmds.go
+var Source string
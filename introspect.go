@@ -0,0 +1,156 @@
+package qws
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+// Kinds of handler a RouteInfo can describe.
+const (
+	KindFunc     = "func"
+	KindDynamic  = "dynamic"
+	KindRouter   = "router"
+	KindCommands = "commands"
+	KindOther    = "other"
+)
+
+// RouteInfo describes one route of a Router, for debugging.
+type RouteInfo struct {
+	Cmd incmds.Cmd `json:"cmd"`
+	// Hi is set for mounts, which cover Cmd to Hi.
+	Hi   incmds.Cmd `json:"hi,omitempty"`
+	Kind string     `json:"kind"`
+	// Name is the function of a KindFunc route, the Name of a KindRouter
+	// route and the Go type of a KindOther route.
+	Name string `json:"name,omitempty"`
+	// In and Out are the types a KindDynamic route decodes and replies with.
+	In      string   `json:"in,omitempty"`
+	Out     string   `json:"out,omitempty"`
+	Options []string `json:"options,omitempty"`
+	// Routes are the routes of a KindRouter route.
+	Routes []RouteInfo `json:"routes,omitempty"`
+	// Commands are the chat commands of a KindCommands route.
+	Commands []string `json:"commands,omitempty"`
+}
+
+// describer is implemented by handlers that know more about themselves than
+// their Go type tells.
+type describer interface {
+	describe(info *RouteInfo)
+}
+
+func (h *DynamicHandler[T, R]) describe(info *RouteInfo) {
+	info.Kind = KindDynamic
+	info.In, info.Out = reflect.TypeFor[T]().String(), reflect.TypeFor[R]().String()
+}
+
+func (h *DynamicErrHandler[T, R]) describe(info *RouteInfo) {
+	info.Kind = KindDynamic
+	info.In, info.Out = reflect.TypeFor[T]().String(), reflect.TypeFor[R]().String()
+}
+
+// Routes lists the commands registered on the router, then its mounts, each
+// in command order. Nested routers are listed inside the route they are
+// mounted on.
+func (r *Router) Routes() []RouteInfo {
+	if r == nil {
+		return nil
+	}
+	return r.routeInfo(map[*Router]bool{})
+}
+
+func (r *Router) routeInfo(seen map[*Router]bool) []RouteInfo {
+	seen[r] = true
+	defer delete(seen, r)
+
+	type entry struct {
+		CmdRange
+		rt      *route
+		mounted bool
+	}
+	t := r.load()
+	entries := make([]entry, 0, len(t.routes)+len(t.mounts))
+	for cmd, rt := range t.routes {
+		entries = append(entries, entry{CmdRange{cmd, cmd}, rt, false})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Lo < entries[j].Lo })
+	for _, m := range t.mounts {
+		entries = append(entries, entry{m.CmdRange, m.route, true})
+	}
+
+	list := make([]RouteInfo, len(entries))
+	for i, e := range entries {
+		info := RouteInfo{Cmd: e.Lo, Options: e.rt.options()}
+		if e.mounted {
+			info.Hi = e.Hi
+		}
+		describe(e.rt.handler, &info, seen)
+		list[i] = info
+	}
+	return list
+}
+
+func describe(h Handler, info *RouteInfo, seen map[*Router]bool) {
+	switch h := h.(type) {
+	case describer:
+		h.describe(info)
+	case HandlerFunc:
+		info.Kind = KindFunc
+		if fn := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); fn != nil {
+			info.Name = fn.Name()
+		}
+	case *Router:
+		info.Kind = KindRouter
+		info.Name = h.Name
+		if !seen[h] {
+			info.Routes = h.routeInfo(seen)
+		}
+	case *CmdRouter:
+		info.Kind = KindCommands
+		for _, list := range [][]Command{h.Global, h.Lobby, h.LobbyAdmin} {
+			for _, c := range list {
+				info.Commands = append(info.Commands, c.Base)
+			}
+		}
+	default:
+		info.Kind = KindOther
+		info.Name = fmt.Sprintf("%T", h)
+	}
+}
+
+// options lists the route options rt was registered with.
+func (rt *route) options() []string {
+	var opts []string
+	if rt.concurrent {
+		opts = append(opts, "concurrent")
+	}
+	if rt.strict {
+		opts = append(opts, "strict")
+	}
+	if rt.idem != nil {
+		opts = append(opts, "idempotent="+rt.idem.window.String())
+	}
+	if rt.timeout > 0 {
+		opts = append(opts, "timeout="+rt.timeout.String())
+	}
+	if rt.perms.minAdmin > 0 {
+		opts = append(opts, fmt.Sprintf("minAdmin=%d", rt.perms.minAdmin))
+	}
+	if rt.perms.registered {
+		opts = append(opts, "registered")
+	}
+	if rt.perms.notGhosted {
+		opts = append(opts, "notGhosted")
+	}
+	if rt.perms.inLobby {
+		opts = append(opts, "inLobby")
+	}
+	if len(rt.middleware) > 0 {
+		opts = append(opts, fmt.Sprintf("middleware=%d", len(rt.middleware)))
+	}
+	return opts
+}
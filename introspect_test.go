@@ -0,0 +1,43 @@
+package qws
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestRoutesDescribesHandlers(t *testing.T) {
+	lobby := NewRouter()
+	lobby.Name = "lobby"
+	HandleDynamic(lobby, incmds.MapSave, func(ctx context.Context, c UserConner, in []int) string {
+		return ""
+	}, Strict(), MinAdmin(AdminLevelMod))
+	r := NewRouter()
+	r.HandleFunc(incmds.StatsTop, func(ctx context.Context, c *UserConn, m *RawMessage) {}, Concurrent(), RouteTimeout(time.Second))
+	r.Handle(incmds.ChatCommand, &CmdRouter{Global: []Command{{Base: "/roll"}}})
+	r.Handle(incmds.LobbyCmds, lobby, InLobbyOnly())
+
+	routes := r.Routes()
+	if len(routes) != 3 {
+		t.Fatalf("got %d routes: %+v", len(routes), routes)
+	}
+	chat, stats, mount := routes[0], routes[1], routes[2]
+	if chat.Cmd != incmds.ChatCommand || chat.Kind != KindCommands || len(chat.Commands) != 1 || chat.Commands[0] != "/roll" {
+		t.Errorf("chat route is %+v", chat)
+	}
+	if stats.Kind != KindFunc || !strings.Contains(stats.Name, "TestRoutesDescribesHandlers") ||
+		strings.Join(stats.Options, " ") != "concurrent timeout=1s" {
+		t.Errorf("stats route is %+v", stats)
+	}
+	if mount.Cmd != LobbyRange.Lo || mount.Hi != LobbyRange.Hi || mount.Kind != KindRouter || mount.Name != "lobby" ||
+		strings.Join(mount.Options, " ") != "inLobby" || len(mount.Routes) != 1 {
+		t.Fatalf("lobby mount is %+v", mount)
+	}
+	if save := mount.Routes[0]; save.Kind != KindDynamic || save.In != "[]int" || save.Out != "string" ||
+		strings.Join(save.Options, " ") != "strict minAdmin=2" {
+		t.Errorf("map save route is %+v", save)
+	}
+}
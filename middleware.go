@@ -0,0 +1,136 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/amh11706/logger"
+)
+
+// Middleware wraps a Handler with behaviour that runs around it, like
+// recovering panics or checking permissions.
+type Middleware func(Handler) Handler
+
+// DefaultMiddleware wraps every message a connection handles, around its
+// router and everything the router adds. Timeouts are set per route, see
+// RouteTimeout.
+var DefaultMiddleware = []Middleware{Recover()}
+
+// chain applies mw so the first one is the outermost.
+func chain(h Handler, mw []Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Use adds middleware around every route of the router, including routes
+// registered before the call. Nested routers apply their own on top.
+func (r *Router) Use(mw ...Middleware) {
+	r.write(func(t *routeTable) error {
+		t.middleware = append(t.middleware, mw...)
+		return nil
+	})
+}
+
+// With adds middleware around a single route, inside the router's own.
+func With(mw ...Middleware) RouteOption {
+	return func(r *route) {
+		r.middleware = append(r.middleware, mw...)
+	}
+}
+
+// Recover turns a panicking handler into a log entry and a message to the
+// user, rather than a crashed server.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+			defer func() {
+				if r := recover(); r != nil {
+					message := fmt.Sprintf("Panic serving %s: %v", c.PrintName(), r)
+					logger.CheckStack(errors.New(message))
+					c.SendInfo(ctx, "Something went wrong...")
+				}
+			}()
+			next.ServeWS(ctx, c, m)
+		})
+	}
+}
+
+// Timeout cancels the handler's context after d. It can only shorten the
+// route's own timeout.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			next.ServeWS(ctx, c, m)
+		})
+	}
+}
+
+// RequireAdmin refuses messages from users below level, the same way the
+// MinAdmin route option does.
+func RequireAdmin(level AdminLevel) Middleware {
+	return func(next Handler) Handler {
+		return permissions{minAdmin: level}.guard(next)
+	}
+}
+
+// LogRequests logs every message before it is handled.
+func LogRequests() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+			log.Printf("\x1b[36m%s\x1b[0m cmd %d id %d: %s\n", c.PrintName(), m.Cmd, m.Id, m.Data)
+			next.ServeWS(ctx, c, m)
+		})
+	}
+}
+
+// Latency reports how long each message took to handle.
+func Latency(observe func(c *UserConn, m *RawMessage, d time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+			start := time.Now()
+			defer func() { observe(c, m, time.Since(start)) }()
+			next.ServeWS(ctx, c, m)
+		})
+	}
+}
+
+// CmdMiddleware wraps a chat command handler the way Middleware wraps a
+// Handler.
+type CmdMiddleware func(CmdHandler) CmdHandler
+
+// Use adds middleware around every command of the router.
+func (r *CmdRouter) Use(mw ...CmdMiddleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// WrapCmd adds middleware around a single command's handler, inside the
+// router's own.
+func WrapCmd(h CmdHandler, mw ...CmdMiddleware) CmdHandler {
+	return chainCmd(h, mw)
+}
+
+func chainCmd(h CmdHandler, mw []CmdMiddleware) CmdHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// RequireCmdAdmin refuses a command to users below level.
+func RequireCmdAdmin(level AdminLevel) CmdMiddleware {
+	return func(next CmdHandler) CmdHandler {
+		return func(ctx context.Context, c UserConner, params []string) string {
+			if c.AdminLevel() < level {
+				return DeniedAdmin
+			}
+			return next(ctx, c, params)
+		}
+	}
+}
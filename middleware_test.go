@@ -0,0 +1,87 @@
+package qws
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+				calls = append(calls, name)
+				next.ServeWS(ctx, c, m)
+			})
+		}
+	}
+	r := NewRouter()
+	r.HandleFunc(incmds.Ready, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		calls = append(calls, "handler")
+	}, With(tag("route")))
+	r.Use(tag("router"))
+
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.Ready})
+	if want := []string{"router", "route", "handler"}; !slices.Equal(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestBuiltinMiddleware(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	r := NewRouter()
+	ran := false
+	r.HandleFunc(incmds.MapDelete, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		ran = true
+	}, With(RequireAdmin(AdminLevelMod)))
+	r.HandleFunc(incmds.Bomb, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("handler has no deadline")
+		}
+		panic("boom")
+	}, With(Recover(), Timeout(time.Second)))
+	var took time.Duration
+	r.Use(Latency(func(c *UserConn, m *RawMessage, d time.Duration) { took = d }))
+
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapDelete})
+	if ran {
+		t.Fatal("a user ran an admin only route")
+	}
+	b.User().AdminLvl = AdminLevelMod
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapDelete})
+	if !ran || took <= 0 {
+		t.Fatalf("admin route ran %v, took %v", ran, took)
+	}
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.Bomb})
+}
+
+func TestCmdRouterMiddleware(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	var seen []string
+	kick := WrapCmd(func(ctx context.Context, c UserConner, params []string) string {
+		seen = append(seen, params[0])
+		return ""
+	}, RequireCmdAdmin(AdminLevelMod))
+	r := &CmdRouter{Global: []Command{{"/kick", "name", "Kick a player.", kick}}}
+	r.Use(func(next CmdHandler) CmdHandler {
+		return func(ctx context.Context, c UserConner, params []string) string {
+			seen = append(seen, "use")
+			return next(ctx, c, params)
+		}
+	})
+
+	h := chainCmd(r.findHandler("/kick").Handler, r.middleware)
+	if res := h(t.Context(), b, []string{"bob"}); res == "" {
+		t.Fatal("a user kicked without permission")
+	}
+	b.User().AdminLvl = AdminLevelMod
+	h(t.Context(), b, []string{"bob"})
+	if want := []string{"use", "use", "bob"}; !slices.Equal(seen, want) {
+		t.Fatalf("seen = %v, want %v", seen, want)
+	}
+}
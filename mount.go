@@ -0,0 +1,111 @@
+package qws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+// CmdRange is an inclusive range of commands a handler is mounted on.
+type CmdRange struct {
+	Lo, Hi incmds.Cmd
+}
+
+func (r CmdRange) Contains(cmd incmds.Cmd) bool {
+	return r.Lo <= cmd && cmd <= r.Hi
+}
+
+// LobbyRange holds the lobby commands. Handling incmds.LobbyCmds mounts the
+// handler on it, as lobbies have always been routed.
+var LobbyRange = CmdRange{incmds.LobbyCmds, incmds.LobbyCmds + 99}
+
+type mount struct {
+	CmdRange
+	route *route
+}
+
+// Mount routes every command in lo to hi to h, usually a child Router.
+// Commands registered with Handle on this router still take precedence.
+// Mounts can be added and removed at any time, like when a user joins or
+// leaves a lobby.
+func (r *Router) Mount(lo, hi incmds.Cmd, h Handler, opts ...RouteOption) error {
+	if hi < lo {
+		return fmt.Errorf("Mount: empty range %d-%d", lo, hi)
+	}
+	rt := &route{handler: h}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return r.write(func(t *routeTable) error {
+		for _, m := range t.mounts {
+			if lo <= m.Hi && m.Lo <= hi {
+				return fmt.Errorf("Mount: %d-%d overlaps %d-%d", lo, hi, m.Lo, m.Hi)
+			}
+		}
+		t.mounts = append(t.mounts, &mount{CmdRange{lo, hi}, rt})
+		sort.Slice(t.mounts, func(i, j int) bool { return t.mounts[i].Lo < t.mounts[j].Lo })
+		return nil
+	})
+}
+
+// Unmount removes the mount starting at lo.
+func (r *Router) Unmount(lo incmds.Cmd) {
+	if r == nil {
+		return
+	}
+	r.write(func(t *routeTable) error {
+		for i, m := range t.mounts {
+			if m.Lo == lo {
+				t.mounts = append(t.mounts[:i], t.mounts[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Mounts lists the ranges mounted on the router.
+func (r *Router) Mounts() []CmdRange {
+	mounts := r.load().mounts
+	ranges := make([]CmdRange, len(mounts))
+	for i, m := range mounts {
+		ranges[i] = m.CmdRange
+	}
+	return ranges
+}
+
+// Resolve returns the routers a message for cmd would pass through, starting
+// with r and ending with the one that has a route for it. It is empty when
+// nothing would handle cmd.
+func (r *Router) Resolve(cmd incmds.Cmd) []*Router {
+	var path []*Router
+	for r != nil {
+		rt := r.lookup(cmd)
+		if rt == nil {
+			return nil
+		}
+		path = append(path, r)
+		next, ok := rt.handler.(*Router)
+		if !ok || next == r {
+			return path
+		}
+		r = next
+	}
+	return nil
+}
+
+type servedByKey struct{}
+
+// ServedBy returns the routers the message being handled passed through, the
+// last one being the router its handler was registered on.
+func ServedBy(ctx context.Context) []*Router {
+	path, _ := ctx.Value(servedByKey{}).([]*Router)
+	return path
+}
+
+func withRouter(ctx context.Context, r *Router) context.Context {
+	path := ServedBy(ctx)
+	return context.WithValue(ctx, servedByKey{}, append(path[:len(path):len(path)], r))
+}
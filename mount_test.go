@@ -0,0 +1,59 @@
+package qws
+
+import (
+	"context"
+	"testing"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestMountRoutesRangeToChild(t *testing.T) {
+	root := &Router{Name: "root"}
+	lobby := &Router{Name: "lobby"}
+	var served []*Router
+	lobby.HandleFunc(incmds.Ready, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		served = ServedBy(ctx)
+	})
+	own := false
+	root.HandleFunc(incmds.Sit, func(ctx context.Context, c *UserConn, m *RawMessage) { own = true })
+
+	if err := root.Mount(100, 199, lobby); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Mount(150, 250, NewRouter()); err == nil {
+		t.Fatal("overlapping mount was accepted")
+	}
+
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	root.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.Ready})
+	if len(served) != 2 || served[0] != root || served[1] != lobby {
+		t.Fatalf("served by %v", served)
+	}
+	root.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.Sit})
+	if !own {
+		t.Fatal("mount shadowed the router's own route")
+	}
+	if path := root.Resolve(incmds.Ready); len(path) != 2 || path[1] != lobby {
+		t.Fatalf("Resolve = %v", path)
+	}
+
+	root.Unmount(100)
+	if path := root.Resolve(incmds.Ready); path != nil {
+		t.Fatalf("unmounted range still resolves to %v", path)
+	}
+}
+
+func TestHandleLobbyCmdsMountsLobbyRange(t *testing.T) {
+	root := NewRouter()
+	lobby := NewRouter()
+	if err := root.Handle(incmds.LobbyCmds, lobby); err != nil {
+		t.Fatal(err)
+	}
+	if ranges := root.Mounts(); len(ranges) != 1 || ranges[0] != LobbyRange {
+		t.Fatalf("mounts = %v", ranges)
+	}
+	root.RemoveCommand(incmds.LobbyCmds)
+	if len(root.Mounts()) != 0 {
+		t.Fatal("RemoveCommand left the lobby mounted")
+	}
+}
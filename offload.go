@@ -0,0 +1,536 @@
+package qws
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// large websocket messages can cause issues for some clients,
+// so we convert larger messages to an http request
+
+// ErrOffloadNotFound is returned for messages that are gone, were never
+// stored, or that the key was not granted a read of.
+var ErrOffloadNotFound = errors.New("offloaded message not found")
+
+// errOffloadDenied is ErrOffloadNotFound for a message this node has but
+// did not grant to the key, which no other node will have either.
+var errOffloadDenied = fmt.Errorf("%w: not granted to this key", ErrOffloadNotFound)
+
+// OffloadStore holds offloaded messages until their readers fetch them over
+// HTTP. One stored message can have many readers, like every recipient of a
+// broadcast, and each reader is granted one read under its connection's
+// FetchKey.
+type OffloadStore interface {
+	// Add stores msg with no readers yet. Grant them before sending them the
+	// id.
+	Add(msg []byte, contentType string) (uuid.UUID, error)
+	// Grant allows one more read of a message by the holder of key. The
+	// empty key can be used by anyone who has the id.
+	Grant(id uuid.UUID, key string)
+	// Hold keeps a message after its last read until Release, so a broadcast
+	// can grant every recipient before any of them finishes reading.
+	Hold(id uuid.UUID)
+	Release(id uuid.UUID)
+	// Get uses one of key's reads of a message.
+	Get(ctx context.Context, id uuid.UUID, key string) (*Offloaded, error)
+	Stats() OffloadStats
+}
+
+// Offloaded is a stored message as it is served.
+type Offloaded struct {
+	Data        []byte
+	ContentType string
+
+	gzipOnce sync.Once
+	gzipped  []byte
+}
+
+// gzip compresses the message once, however many readers ask for it.
+func (m *Offloaded) gzip() []byte {
+	m.gzipOnce.Do(func() {
+		b := &bytes.Buffer{}
+		w := gzip.NewWriter(b)
+		if _, err := w.Write(m.Data); err != nil {
+			return
+		}
+		if w.Close() == nil {
+			m.gzipped = b.Bytes()
+		}
+	})
+	return m.gzipped
+}
+
+// OffloadStats counts what happened to offloaded messages.
+type OffloadStats struct {
+	Stored  uint64
+	Hits    uint64
+	Misses  uint64
+	Denied  uint64
+	Expired uint64
+	Evicted uint64
+	// PeerHits are messages another node served for this one.
+	PeerHits uint64
+	// Entries and Bytes are what is stored right now.
+	Entries int
+	Bytes   int
+}
+
+// Offloads is the store used by prepared messages and HandleHttpMessage. Set
+// it with ConfigureOffloads before any connection is accepted.
+var Offloads OffloadStore = NewMemoryOffloadStore(5*time.Second, 64<<20)
+
+// OffloadConfig selects and sizes the offload store.
+type OffloadConfig struct {
+	// Dir, when set, keeps messages in files there rather than in memory.
+	// Files left by an earlier run are removed.
+	Dir string
+	// TTL is how long a message waits for its readers.
+	TTL time.Duration
+	// MaxBytes caps the size of the stored messages. The oldest are evicted
+	// to make room. A message larger than the cap is kept alone.
+	MaxBytes int
+	// Peers are the offload URLs of the other nodes, each ending where the
+	// message id goes. A fetch for a message this node does not have is
+	// passed on to them.
+	Peers []string
+	// PeerSecret is shared by every node. Fetches passed on between nodes
+	// carry it, so clients cannot pose as a node. It is required with Peers.
+	PeerSecret string
+}
+
+// NewOffloadStore builds the store cfg describes.
+func NewOffloadStore(cfg OffloadConfig) (OffloadStore, error) {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 5 * time.Second
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 64 << 20
+	}
+	var s OffloadStore = NewMemoryOffloadStore(cfg.TTL, cfg.MaxBytes)
+	if cfg.Dir != "" {
+		var err error
+		if s, err = NewDiskOffloadStore(cfg.Dir, cfg.TTL, cfg.MaxBytes); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Peers) > 0 {
+		if cfg.PeerSecret == "" {
+			return nil, errors.New("offload peers need a PeerSecret")
+		}
+		s = &PeerOffloadStore{
+			OffloadStore: s,
+			Peer:         &HTTPOffloadPeer{Nodes: cfg.Peers, Secret: cfg.PeerSecret},
+			Secret:       cfg.PeerSecret,
+		}
+	}
+	return s, nil
+}
+
+// ConfigureOffloads replaces Offloads with the store cfg describes.
+func ConfigureOffloads(cfg OffloadConfig) error {
+	s, err := NewOffloadStore(cfg)
+	if err != nil {
+		return err
+	}
+	Offloads = s
+	return nil
+}
+
+// offloadBlobs is where a local store keeps the messages themselves. Its
+// methods are called without the store's lock held.
+type offloadBlobs interface {
+	put(id uuid.UUID, data []byte) error
+	get(id uuid.UUID) ([]byte, error)
+	del(id uuid.UUID)
+}
+
+// localOffloadStore keeps the grants, expiry and size accounting of the
+// messages stored on this node.
+type localOffloadStore struct {
+	ttl      time.Duration
+	maxBytes int
+	blobs    offloadBlobs
+
+	lock    sync.Mutex
+	entries map[uuid.UUID]*offloadEntry
+	// order holds ids oldest first. Ids that were already removed are
+	// skipped when they reach the front.
+	order []uuid.UUID
+	bytes int
+	stats OffloadStats
+}
+
+type offloadEntry struct {
+	size        int
+	contentType string
+	grants      map[string]int
+	reads       int
+	holds       int
+	timer       *time.Timer
+	// served is handed to every reader of a message kept in memory, so it
+	// is only compressed once.
+	served *Offloaded
+}
+
+// NewMemoryOffloadStore keeps messages in this process.
+func NewMemoryOffloadStore(ttl time.Duration, maxBytes int) OffloadStore {
+	return newLocalOffloadStore(ttl, maxBytes, &memoryBlobs{data: make(map[uuid.UUID][]byte)})
+}
+
+// NewDiskOffloadStore keeps messages in files under dir, which it creates.
+func NewDiskOffloadStore(dir string, ttl time.Duration, maxBytes int) (OffloadStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*"+diskOffloadExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range old {
+		os.Remove(f)
+	}
+	return newLocalOffloadStore(ttl, maxBytes, diskBlobs(dir)), nil
+}
+
+func newLocalOffloadStore(ttl time.Duration, maxBytes int, blobs offloadBlobs) *localOffloadStore {
+	return &localOffloadStore{ttl: ttl, maxBytes: maxBytes, blobs: blobs, entries: make(map[uuid.UUID]*offloadEntry)}
+}
+
+func (s *localOffloadStore) Add(msg []byte, contentType string) (uuid.UUID, error) {
+	id := uuid.New()
+	if err := s.blobs.put(id, msg); err != nil {
+		return uuid.Nil, err
+	}
+	var evicted []uuid.UUID
+	s.lock.Lock()
+	s.trim()
+	for len(s.entries) > 0 && s.bytes+len(msg) > s.maxBytes {
+		evicted = append(evicted, s.order[0])
+		s.remove(s.order[0])
+		s.stats.Evicted++
+		s.trim()
+	}
+	e := &offloadEntry{
+		size:        len(msg),
+		contentType: contentType,
+		grants:      make(map[string]int, 1),
+		timer:       time.AfterFunc(s.ttl, func() { s.expire(id) }),
+	}
+	if _, ok := s.blobs.(*memoryBlobs); ok {
+		e.served = &Offloaded{Data: msg, ContentType: contentType}
+	}
+	s.entries[id] = e
+	s.order = append(s.order, id)
+	s.bytes += len(msg)
+	s.stats.Stored++
+	s.lock.Unlock()
+
+	for _, id := range evicted {
+		s.blobs.del(id)
+	}
+	return id, nil
+}
+
+func (s *localOffloadStore) Grant(id uuid.UUID, key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.entries[id]; e != nil {
+		e.grants[key]++
+		e.reads++
+	}
+}
+
+func (s *localOffloadStore) Hold(id uuid.UUID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e := s.entries[id]; e != nil {
+		e.holds++
+	}
+}
+
+func (s *localOffloadStore) Release(id uuid.UUID) {
+	s.lock.Lock()
+	e := s.entries[id]
+	done := false
+	if e != nil {
+		e.holds--
+		done = s.removeIfDone(id, e)
+	}
+	s.lock.Unlock()
+	if done {
+		s.blobs.del(id)
+	}
+}
+
+func (s *localOffloadStore) Get(ctx context.Context, id uuid.UUID, key string) (*Offloaded, error) {
+	return s.fetch(id, key)
+}
+
+// fetch reads the message before using the grant, so a message kept in a
+// file is not read with the lock held.
+func (s *localOffloadStore) fetch(id uuid.UUID, key string) (*Offloaded, error) {
+	s.lock.Lock()
+	e := s.entries[id]
+	if e == nil {
+		s.stats.Misses++
+		s.lock.Unlock()
+		return nil, ErrOffloadNotFound
+	}
+	if e.grants[key] == 0 {
+		key = ""
+	}
+	if e.grants[key] == 0 {
+		s.stats.Denied++
+		s.lock.Unlock()
+		return nil, errOffloadDenied
+	}
+	m := e.served
+	s.lock.Unlock()
+
+	if m == nil {
+		data, err := s.blobs.get(id)
+		if err != nil {
+			return nil, ErrOffloadNotFound
+		}
+		m = &Offloaded{Data: data, ContentType: e.contentType}
+	}
+
+	s.lock.Lock()
+	if s.entries[id] != e || e.grants[key] == 0 {
+		// Another reader used the grant, or the message expired, while
+		// this one was reading.
+		s.stats.Misses++
+		s.lock.Unlock()
+		return nil, ErrOffloadNotFound
+	}
+	s.stats.Hits++
+	if e.grants[key]--; e.grants[key] == 0 {
+		delete(e.grants, key)
+	}
+	e.reads--
+	done := s.removeIfDone(id, e)
+	s.lock.Unlock()
+	if done {
+		s.blobs.del(id)
+	}
+	return m, nil
+}
+
+func (s *localOffloadStore) removeIfDone(id uuid.UUID, e *offloadEntry) bool {
+	if e.reads <= 0 && e.holds <= 0 {
+		s.remove(id)
+		return true
+	}
+	return false
+}
+
+func (s *localOffloadStore) Stats() OffloadStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stats := s.stats
+	stats.Entries = len(s.entries)
+	stats.Bytes = s.bytes
+	return stats
+}
+
+func (s *localOffloadStore) expire(id uuid.UUID) {
+	s.lock.Lock()
+	expired := s.entries[id] != nil
+	if expired {
+		s.remove(id)
+		s.stats.Expired++
+	}
+	s.lock.Unlock()
+	if expired {
+		s.blobs.del(id)
+	}
+}
+
+// remove forgets a message. The caller deletes its blob once the lock is
+// released.
+func (s *localOffloadStore) remove(id uuid.UUID) {
+	e := s.entries[id]
+	if e == nil {
+		return
+	}
+	e.timer.Stop()
+	delete(s.entries, id)
+	s.bytes -= e.size
+}
+
+// trim drops removed ids from the front of order.
+func (s *localOffloadStore) trim() {
+	i := 0
+	for i < len(s.order) && s.entries[s.order[i]] == nil {
+		i++
+	}
+	s.order = s.order[i:]
+}
+
+type memoryBlobs struct {
+	lock sync.Mutex
+	data map[uuid.UUID][]byte
+}
+
+func (b *memoryBlobs) put(id uuid.UUID, data []byte) error {
+	b.lock.Lock()
+	b.data[id] = data
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *memoryBlobs) get(id uuid.UUID) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	data, ok := b.data[id]
+	if !ok {
+		return nil, ErrOffloadNotFound
+	}
+	return data, nil
+}
+
+func (b *memoryBlobs) del(id uuid.UUID) {
+	b.lock.Lock()
+	delete(b.data, id)
+	b.lock.Unlock()
+}
+
+const diskOffloadExt = ".qwsmsg"
+
+type diskBlobs string
+
+func (d diskBlobs) path(id uuid.UUID) string {
+	return filepath.Join(string(d), id.String()+diskOffloadExt)
+}
+
+func (d diskBlobs) put(id uuid.UUID, data []byte) error {
+	return os.WriteFile(d.path(id), data, 0o600)
+}
+
+func (d diskBlobs) get(id uuid.UUID) ([]byte, error) {
+	return os.ReadFile(d.path(id))
+}
+
+func (d diskBlobs) del(id uuid.UUID) {
+	os.Remove(d.path(id))
+}
+
+// OffloadPeer finds messages that were offloaded on another node, for when
+// the client's fetch is routed to a node other than the one it is connected
+// to.
+type OffloadPeer interface {
+	Fetch(ctx context.Context, id uuid.UUID, key string) (*Offloaded, error)
+}
+
+// PeerOffloadStore stores messages locally and asks Peer for the ones it does
+// not have.
+type PeerOffloadStore struct {
+	OffloadStore
+	Peer OffloadPeer
+	// Secret is what other nodes send in OffloadPeerHeader. Fetches
+	// without it come from clients and may be passed on.
+	Secret string
+
+	lock     sync.Mutex
+	peerHits uint64
+}
+
+type peerRequestKey struct{}
+
+// fromPeer marks ctx as serving another node, which must not be forwarded
+// again.
+func fromPeer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peerRequestKey{}, true)
+}
+
+func (s *PeerOffloadStore) Get(ctx context.Context, id uuid.UUID, key string) (*Offloaded, error) {
+	m, err := s.OffloadStore.Get(ctx, id, key)
+	if err == nil || errors.Is(err, errOffloadDenied) || ctx.Value(peerRequestKey{}) != nil {
+		return m, err
+	}
+	m, err = s.Peer.Fetch(ctx, id, key)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.peerHits++
+	s.lock.Unlock()
+	return m, nil
+}
+
+func (s *PeerOffloadStore) Stats() OffloadStats {
+	stats := s.OffloadStore.Stats()
+	s.lock.Lock()
+	stats.PeerHits = s.peerHits
+	s.lock.Unlock()
+	return stats
+}
+
+// OffloadPeerHeader marks a fetch made by another node. It carries the
+// nodes' PeerSecret.
+const OffloadPeerHeader = "X-Qws-Offload-Peer"
+
+// isPeer reports whether r was made by another node.
+func (s *PeerOffloadStore) isPeer(r *http.Request) bool {
+	got := r.Header.Get(OffloadPeerHeader)
+	return s.Secret != "" && subtle.ConstantTimeCompare([]byte(got), []byte(s.Secret)) == 1
+}
+
+// HTTPOffloadPeer asks the OffloadHandler of each other node in turn.
+type HTTPOffloadPeer struct {
+	// Nodes are URLs that the message id is appended to.
+	Nodes  []string
+	Client *http.Client
+	// Secret is sent in OffloadPeerHeader. It must match the other nodes'
+	// PeerOffloadStore Secret.
+	Secret string
+}
+
+func (p *HTTPOffloadPeer) Fetch(ctx context.Context, id uuid.UUID, key string) (*Offloaded, error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	var errs []error
+	for _, node := range p.Nodes {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(node, "/")+"/"+id.String(), nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		req.Header.Set(FetchKeyHeader, key)
+		req.Header.Set(OffloadPeerHeader, p.Secret)
+		res, err := client.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		data, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case res.StatusCode == http.StatusOK:
+			return &Offloaded{Data: data, ContentType: res.Header.Get("Content-Type")}, nil
+		case res.StatusCode != http.StatusNotFound:
+			errs = append(errs, fmt.Errorf("offload peer %s: %s", node, res.Status))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrOffloadNotFound
+}
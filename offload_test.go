@@ -0,0 +1,182 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+	"github.com/google/uuid"
+)
+
+func mustAdd(t *testing.T, s OffloadStore, msg string) uuid.UUID {
+	t.Helper()
+	id, err := s.Add([]byte(msg), "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func testOffloadStoreGrants(t *testing.T, s OffloadStore) {
+	id := mustAdd(t, s, "big")
+	s.Grant(id, "a")
+	s.Grant(id, "b")
+	if _, err := s.Get(t.Context(), id, "c"); !errors.Is(err, ErrOffloadNotFound) {
+		t.Fatalf("a key without a grant got %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if m, err := s.Get(t.Context(), id, key); err != nil || string(m.Data) != "big" {
+			t.Fatalf("reader %s got %v, %v", key, m, err)
+		}
+	}
+	if _, err := s.Get(t.Context(), id, "a"); err != ErrOffloadNotFound {
+		t.Fatal("message outlived its readers")
+	}
+	stats := s.Stats()
+	if stats.Hits != 2 || stats.Denied != 1 || stats.Misses != 1 || stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestMemoryOffloadStoreServesEveryGrantedReader(t *testing.T) {
+	testOffloadStoreGrants(t, NewMemoryOffloadStore(time.Minute, 1<<20))
+}
+
+func TestDiskOffloadStoreServesEveryGrantedReader(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/stale"+diskOffloadExt, []byte("old"), 0o600)
+	s, err := NewDiskOffloadStore(dir, time.Minute, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOffloadStoreGrants(t, s)
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files left behind", len(files))
+	}
+}
+
+func TestOffloadStoreExpiresAndEvicts(t *testing.T) {
+	s := NewMemoryOffloadStore(20*time.Millisecond, 10)
+	first := mustAdd(t, s, "aaaaaa")
+	s.Grant(first, "")
+	second := mustAdd(t, s, "bbbbbb")
+	s.Grant(second, "")
+	if _, err := s.Get(t.Context(), first, ""); err == nil {
+		t.Fatal("oldest message was not evicted to make room")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := s.Get(t.Context(), second, ""); err == nil {
+		t.Fatal("message outlived its TTL")
+	}
+	stats := s.Stats()
+	if stats.Evicted != 1 || stats.Expired != 1 || stats.Bytes != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestPeerOffloadStoreFetchesFromOtherNode(t *testing.T) {
+	other := NewMemoryOffloadStore(time.Minute, 1<<20)
+	srv := httptest.NewServer(&OffloadHandler{Store: other})
+	defer srv.Close()
+	id := mustAdd(t, other, "elsewhere")
+	other.Grant(id, "key")
+
+	s, err := NewOffloadStore(OffloadConfig{Peers: []string{srv.URL + "/msg/"}, PeerSecret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.Get(t.Context(), id, "key")
+	if err != nil || string(m.Data) != "elsewhere" || m.ContentType != "application/json" {
+		t.Fatalf("Get = %v, %v", m, err)
+	}
+	if s.Stats().PeerHits != 1 {
+		t.Fatalf("stats = %+v", s.Stats())
+	}
+	if _, err := s.Get(fromPeer(context.Background()), uuid.New(), "key"); err != ErrOffloadNotFound {
+		t.Fatalf("a peer's request was passed on: %v", err)
+	}
+
+	// A node that is down does not hide a miss behind a 404.
+	srv.Close()
+	if _, err := s.Get(t.Context(), uuid.New(), "key"); err == nil || err == ErrOffloadNotFound {
+		t.Fatalf("unreachable peer returned %v", err)
+	}
+}
+
+type countingPeer struct{ fetches int }
+
+func (p *countingPeer) Fetch(ctx context.Context, id uuid.UUID, key string) (*Offloaded, error) {
+	p.fetches++
+	return nil, ErrOffloadNotFound
+}
+
+func TestOffloadHandlerOnlyTrustsPeersWithTheSecret(t *testing.T) {
+	peer := &countingPeer{}
+	s := &PeerOffloadStore{OffloadStore: NewMemoryOffloadStore(time.Minute, 1<<20), Peer: peer, Secret: "s3cret"}
+	h := &OffloadHandler{Store: s, PerSecond: 1, Burst: 2}
+	fetch := func(id uuid.UUID, key, secret string) int {
+		r := httptest.NewRequest(http.MethodGet, "/msg/"+id.String(), nil)
+		r.Header.Set(FetchKeyHeader, key)
+		if secret != "" {
+			r.Header.Set(OffloadPeerHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := fetch(uuid.New(), "key", "s3cret"); code == http.StatusTooManyRequests {
+			t.Fatal("a node's fetches were rate limited")
+		}
+	}
+
+	fetch(uuid.New(), "key", "s3cret")
+	if peer.fetches != 0 {
+		t.Fatal("a fetch from a node was passed on again")
+	}
+	fetch(uuid.New(), "key", "guess")
+	if peer.fetches != 1 {
+		t.Fatal("a client posing as a node was not treated as a client")
+	}
+	id := mustAdd(t, s, "mine")
+	s.Grant(id, "key")
+	if code := fetch(id, "other", ""); code != http.StatusNotFound {
+		t.Fatalf("a denied key got %d, want %d", code, http.StatusNotFound)
+	}
+	if peer.fetches != 1 {
+		t.Fatal("a key this node denied was passed on to the peers")
+	}
+}
+
+func TestBroadcastOffloadReachesEveryRecipient(t *testing.T) {
+	list := UserList[*BotConn]{}
+	var got []<-chan *ClientMessage
+	for i := int64(1); i <= 3; i++ {
+		b := NewBotConn(-i, &User{Name: "Bot"})
+		got = append(got, b.Subscribe(outcmds.Sync, 1))
+		b.Start(t.Context())
+		defer b.Close()
+		list[b.Id()] = b
+	}
+
+	list.Broadcast(t.Context(), outcmds.Sync, make([]int, MaxJsonSize))
+	// Each bot decodes a large message, which is slow under -race, so the
+	// recipients share one generous deadline.
+	deadline := time.After(10 * time.Second)
+	for i, ch := range got {
+		select {
+		case m := <-ch:
+			if len(m.Data) < MaxJsonSize {
+				t.Fatalf("recipient %d got %d bytes", i, len(m.Data))
+			}
+		case <-deadline:
+			t.Fatalf("recipient %d could not fetch the broadcast", i)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package qws
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+)
+
+// Priority decides which queued frame is written next. Lower values go first.
+type Priority byte
+
+const (
+	PriorityControl Priority = iota
+	PriorityGame
+	PriorityChat
+	PriorityList
+	priorityCount
+)
+
+// SendPolicy is how frames for one outcmds.Cmd are queued.
+type SendPolicy struct {
+	Priority Priority
+	// TTL drops a frame that could not be written in time. Zero never expires.
+	TTL time.Duration
+}
+
+var sendPolicies = map[outcmds.Cmd]SendPolicy{
+	outcmds.SessionId:     {Priority: PriorityControl},
+	outcmds.Copy:          {Priority: PriorityControl},
+	outcmds.Kick:          {Priority: PriorityControl},
+	outcmds.NavigateTo:    {Priority: PriorityControl},
+	outcmds.Reload:        {Priority: PriorityControl},
+	outcmds.SetUser:       {Priority: PriorityControl},
+	outcmds.SessionResume: {Priority: PriorityControl},
+
+	outcmds.ChatMessage: {Priority: PriorityChat},
+
+	outcmds.FriendList:  {Priority: PriorityList},
+	outcmds.QueueLength: {Priority: PriorityList},
+	outcmds.LobbyList:   {Priority: PriorityList},
+	outcmds.LobbyUpdate: {Priority: PriorityList},
+	outcmds.PlayerList:  {Priority: PriorityList},
+
+	outcmds.BoatTick:  {Priority: PriorityGame, TTL: 2 * time.Second},
+	outcmds.BoatTicks: {Priority: PriorityGame, TTL: 2 * time.Second},
+}
+
+var defaultSendPolicy = SendPolicy{Priority: PriorityGame}
+
+// SetSendPolicy overrides how frames for cmd are queued. It is meant to be
+// called during startup, before any connections exist.
+func SetSendPolicy(cmd outcmds.Cmd, p SendPolicy) {
+	sendPolicies[cmd] = p
+}
+
+func sendPolicyFor(cmd outcmds.Cmd) SendPolicy {
+	if p, ok := sendPolicies[cmd]; ok {
+		return p
+	}
+	return defaultSendPolicy
+}
+
+// Frame is a prepared message along with how the outbox should treat it. A
+// frame is never modified once queued, so one can be shared by every
+// recipient of a broadcast.
+type Frame struct {
+	Message  *PreparedMessage
+	Priority Priority
+	// Key, when set, replaces any queued frame with the same key.
+	Key string
+	// Expires, when set, drops the frame if it has not been written by then.
+	Expires time.Time
+	// NoDrop keeps the frame when the outbox overflows, for frames that are
+	// useless to the client unless every one of them arrives, like the
+	// chunks of a message. It does not count against the limit, so it never
+	// pushes other frames out either.
+	NoDrop bool
+}
+
+// NewFrame wraps a message for cmd using the command's SendPolicy.
+func NewFrame(cmd outcmds.Cmd, m *PreparedMessage) *Frame {
+	p := sendPolicyFor(cmd)
+	f := &Frame{Message: m, Priority: p.Priority}
+	if p.TTL > 0 {
+		f.Expires = time.Now().Add(p.TTL)
+	}
+	return f
+}
+
+// NewKeyedFrame is NewFrame for a message that replaces the state sent by
+// the last one for the same cmd and key, such as a LobbyUpdate keyed by its
+// lobby. A queued frame with the same cmd and key is dropped in its favour.
+func NewKeyedFrame(cmd outcmds.Cmd, key string, m *PreparedMessage) *Frame {
+	f := NewFrame(cmd, m)
+	f.Key = strconv.Itoa(int(cmd)) + "/" + key
+	return f
+}
+
+// OverflowPolicy is what a connection does when its outbox is full.
+type OverflowPolicy byte
+
+const (
+	// OverflowDropLowest drops the oldest frame of the lowest priority
+	// queued, which may be the new frame itself.
+	OverflowDropLowest OverflowPolicy = iota
+	// OverflowDropNewest drops the frame being sent.
+	OverflowDropNewest
+	// OverflowClose closes the connection.
+	OverflowClose
+)
+
+var (
+	// OutboxLimit is how many frames a connection can have queued.
+	OutboxLimit = 256
+	// DefaultOverflowPolicy applies to connections that do not set their own.
+	// Closing is the default because a dropped frame may carry state the
+	// client needs; connections whose frames can be lost opt into dropping.
+	DefaultOverflowPolicy = OverflowClose
+)
+
+// OutboxStats counts frames that were queued but never written.
+type OutboxStats struct {
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+	Expired   uint64 `json:"expired"`
+}
+
+type outboxCounters struct {
+	dropped, coalesced, expired atomic.Uint64
+}
+
+func (c *outboxCounters) stats() OutboxStats {
+	return OutboxStats{Dropped: c.dropped.Load(), Coalesced: c.coalesced.Load(), Expired: c.expired.Load()}
+}
+
+var totalOutbox outboxCounters
+
+// TotalOutboxStats sums OutboxStats over every connection since startup.
+func TotalOutboxStats() OutboxStats {
+	return totalOutbox.stats()
+}
+
+// queued is an outbox slot. Coalescing swaps the frame in its slot, so the
+// newest state goes out where the oldest was waiting.
+type queued struct {
+	*Frame
+}
+
+type outbox struct {
+	lock  sync.Mutex
+	lanes [priorityCount][]*queued
+	keyed map[string]*queued
+	size  int
+	// noDrop is how many of the queued frames are NoDrop, which size counts
+	// but the limit does not.
+	noDrop int
+	limit  int
+	policy OverflowPolicy
+	// ready holds a token whenever there may be frames to write.
+	ready    chan struct{}
+	counters outboxCounters
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		keyed:  make(map[string]*queued),
+		limit:  OutboxLimit,
+		policy: DefaultOverflowPolicy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push queues f. It returns false if the outbox is full and its policy says
+// to close the connection.
+func (o *outbox) push(f *Frame) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if f.Key != "" {
+		if q := o.keyed[f.Key]; q != nil {
+			q.Frame = f
+			o.counters.coalesced.Add(1)
+			totalOutbox.coalesced.Add(1)
+			return true
+		}
+	}
+	if !f.NoDrop && o.size-o.noDrop >= o.limit {
+		switch o.policy {
+		case OverflowClose:
+			return false
+		case OverflowDropNewest:
+			o.dropped()
+			return true
+		case OverflowDropLowest:
+			if !o.dropLowest(f.Priority) {
+				o.dropped()
+				return true
+			}
+		}
+	}
+
+	q := &queued{Frame: f}
+	o.lanes[f.Priority] = append(o.lanes[f.Priority], q)
+	if f.Key != "" {
+		o.keyed[f.Key] = q
+	}
+	o.size++
+	if f.NoDrop {
+		o.noDrop++
+	}
+	o.signal()
+	return true
+}
+
+// dropLowest makes room for a frame of priority p by dropping the oldest
+// frame of a lower or equal priority that is not NoDrop. It reports false if
+// there is none.
+func (o *outbox) dropLowest(p Priority) bool {
+	for lane := int(priorityCount) - 1; lane >= int(p); lane-- {
+		for i, q := range o.lanes[lane] {
+			if !q.NoDrop {
+				o.removeAt(Priority(lane), i)
+				o.dropped()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *outbox) dropped() {
+	o.counters.dropped.Add(1)
+	totalOutbox.dropped.Add(1)
+}
+
+func (o *outbox) popLane(lane Priority) *queued {
+	if len(o.lanes[lane]) == 0 {
+		return nil
+	}
+	return o.removeAt(lane, 0)
+}
+
+func (o *outbox) removeAt(lane Priority, i int) *queued {
+	q := o.lanes[lane][i]
+	if i == 0 {
+		o.lanes[lane][0] = nil
+		o.lanes[lane] = o.lanes[lane][1:]
+	} else {
+		o.lanes[lane] = slices.Delete(o.lanes[lane], i, i+1)
+	}
+	o.size--
+	if q.NoDrop {
+		o.noDrop--
+	}
+	if q.Key != "" && o.keyed[q.Key] == q {
+		delete(o.keyed, q.Key)
+	}
+	return q
+}
+
+// pop takes the next frame to write, skipping expired ones, or returns nil
+// if nothing is queued.
+func (o *outbox) pop(now time.Time) *PreparedMessage {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for lane := Priority(0); lane < priorityCount; lane++ {
+		for q := o.popLane(lane); q != nil; q = o.popLane(lane) {
+			if !q.Expires.IsZero() && now.After(q.Expires) {
+				o.counters.expired.Add(1)
+				totalOutbox.expired.Add(1)
+				continue
+			}
+			if o.size > 0 {
+				o.signal()
+			}
+			return q.Message
+		}
+	}
+	return nil
+}
+
+// SetOverflowPolicy changes what this connection does when its outbox fills.
+func (c *Conn) SetOverflowPolicy(p OverflowPolicy) {
+	c.out.lock.Lock()
+	c.out.policy = p
+	c.out.lock.Unlock()
+}
+
+// OutboxStats counts frames this connection dropped, coalesced or let expire.
+func (c *Conn) OutboxStats() OutboxStats {
+	if c == nil {
+		return OutboxStats{}
+	}
+	return c.out.counters.stats()
+}
@@ -0,0 +1,147 @@
+package qws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+	"github.com/gorilla/websocket"
+)
+
+func testFrame(t *testing.T, cmd outcmds.Cmd) *Frame {
+	t.Helper()
+	m, err := PrepareMessage(JSONCodec, cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFrame(cmd, m)
+}
+
+func TestOutboxWritesHigherPrioritiesFirst(t *testing.T) {
+	o := newOutbox()
+	list := testFrame(t, outcmds.PlayerList)
+	chat := testFrame(t, outcmds.ChatMessage)
+	tick := testFrame(t, outcmds.BoatTicks)
+	kick := testFrame(t, outcmds.Kick)
+	for _, f := range []*Frame{list, chat, tick, kick} {
+		o.push(f)
+	}
+
+	now := time.Now()
+	for i, want := range []*Frame{kick, tick, chat, list} {
+		if got := o.pop(now); got != want.Message {
+			t.Fatalf("frame %d written out of priority order", i)
+		}
+	}
+	if o.pop(now) != nil {
+		t.Fatal("outbox was not empty")
+	}
+}
+
+func keyedFrame(t *testing.T, cmd outcmds.Cmd, key string) *Frame {
+	t.Helper()
+	m, err := PrepareMessage(JSONCodec, cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewKeyedFrame(cmd, key, m)
+}
+
+func TestOutboxCoalescesKeyedFrames(t *testing.T) {
+	o := newOutbox()
+	first := keyedFrame(t, outcmds.LobbyUpdate, "1")
+	otherLobby := keyedFrame(t, outcmds.LobbyUpdate, "2")
+	otherCmd := keyedFrame(t, outcmds.LobbyList, "1")
+	unkeyed := testFrame(t, outcmds.LobbyUpdate)
+	last := keyedFrame(t, outcmds.LobbyUpdate, "1")
+	for _, f := range []*Frame{first, otherLobby, otherCmd, unkeyed, last} {
+		o.push(f)
+	}
+
+	now := time.Now()
+	for i, want := range []*Frame{last, otherLobby, otherCmd, unkeyed} {
+		if got := o.pop(now); got != want.Message {
+			t.Fatalf("frame %d was not the one expected", i)
+		}
+	}
+	if o.pop(now) != nil {
+		t.Fatal("a replaced LobbyUpdate was still queued")
+	}
+	if s := o.counters.stats(); s.Coalesced != 1 {
+		t.Fatalf("coalesced = %d, want 1", s.Coalesced)
+	}
+}
+
+func TestOutboxOverflowDropsLowestPriority(t *testing.T) {
+	o := newOutbox()
+	o.limit = 2
+	o.policy = OverflowDropLowest
+	chat := testFrame(t, outcmds.ChatMessage)
+	tick := testFrame(t, outcmds.BoatTicks)
+	kick := testFrame(t, outcmds.Kick)
+	o.push(chat)
+	o.push(tick)
+	if !o.push(kick) {
+		t.Fatal("drop lowest policy asked to close the connection")
+	}
+
+	now := time.Now()
+	if o.pop(now) != kick.Message || o.pop(now) != tick.Message || o.pop(now) != nil {
+		t.Fatal("overflow did not drop the chat message")
+	}
+	if s := o.counters.stats(); s.Dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", s.Dropped)
+	}
+
+	o.policy = OverflowClose
+	o.push(chat)
+	o.push(tick)
+	if o.push(kick) {
+		t.Fatal("close policy did not report the overflow")
+	}
+}
+
+func TestOutboxOverflowKeepsNoDropFrames(t *testing.T) {
+	o := newOutbox()
+	o.limit = 2
+	m := NewPreparedMessage(websocket.TextMessage, []byte("{}"))
+	chunks := []*Frame{
+		{Message: m, Priority: PriorityList, NoDrop: true},
+		{Message: m, Priority: PriorityList, NoDrop: true},
+		{Message: m, Priority: PriorityList, NoDrop: true},
+	}
+	for _, f := range chunks {
+		o.push(f)
+	}
+	list := testFrame(t, outcmds.PlayerList)
+	o.push(list)
+
+	now := time.Now()
+	for i := range chunks {
+		if o.pop(now) != m {
+			t.Fatalf("chunk %d was dropped", i)
+		}
+	}
+	if o.pop(now) != list.Message || o.pop(now) != nil {
+		t.Fatal("chunks pushed the list out")
+	}
+	if s := o.counters.stats(); s.Dropped != 0 {
+		t.Fatalf("dropped = %d, want 0", s.Dropped)
+	}
+}
+
+func TestOutboxSkipsExpiredFrames(t *testing.T) {
+	o := newOutbox()
+	m := NewPreparedMessage(websocket.TextMessage, []byte("{}"))
+	stale := &Frame{Message: m, Priority: PriorityGame, Expires: time.Now().Add(time.Second)}
+	fresh := testFrame(t, outcmds.Sync)
+	o.push(stale)
+	o.push(fresh)
+
+	if got := o.pop(time.Now().Add(2 * time.Second)); got != fresh.Message {
+		t.Fatal("expired frame was written")
+	}
+	if s := o.counters.stats(); s.Expired != 1 {
+		t.Fatalf("expired = %d, want 1", s.Expired)
+	}
+}
@@ -31,6 +31,9 @@ const (
 	UpdateUser
 	QueueLength
 	QueueMatch
+	SessionResume
+	FetchKey
+	Chunk
 )
 
 const (
@@ -0,0 +1,60 @@
+package outcmds
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// OutCmd pairs a Cmd with the type of the payload sent under it. Sending
+// through an OutCmd lets the compiler catch a payload sent under the wrong
+// command.
+type OutCmd[T any] struct {
+	Cmd Cmd
+}
+
+var (
+	typesLock sync.RWMutex
+	types     = make(map[Cmd]reflect.Type)
+)
+
+// Typed declares that cmd carries a T and records it for PayloadType.
+// Declaring one command with two different types panics.
+func Typed[T any](cmd Cmd) OutCmd[T] {
+	t := reflect.TypeFor[T]()
+	typesLock.Lock()
+	defer typesLock.Unlock()
+	if old, ok := types[cmd]; ok && old != t {
+		panic(fmt.Sprintf("outcmds: cmd %d declared as both %v and %v", cmd, old, t))
+	}
+	types[cmd] = t
+	return OutCmd[T]{Cmd: cmd}
+}
+
+// PayloadType returns the payload type declared for cmd with Typed.
+func PayloadType(cmd Cmd) (reflect.Type, bool) {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	t, ok := types[cmd]
+	return t, ok
+}
+
+// PayloadTypes returns every command declared with Typed and its payload type.
+func PayloadTypes() map[Cmd]reflect.Type {
+	typesLock.RLock()
+	defer typesLock.RUnlock()
+	out := make(map[Cmd]reflect.Type, len(types))
+	for cmd, t := range types {
+		out[cmd] = t
+	}
+	return out
+}
+
+// Commands whose payloads need nothing from qws. Those with payloads defined
+// in qws are declared there, and the app declares the rest next to its
+// payload types.
+var (
+	SessionIdCmd = Typed[int64](SessionId)
+	CopyCmd      = Typed[int64](Copy)
+	FetchKeyCmd  = Typed[string](FetchKey)
+)
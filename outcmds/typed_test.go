@@ -0,0 +1,23 @@
+package outcmds
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTypedRegistersPayloadType(t *testing.T) {
+	if typ, ok := PayloadType(SessionId); !ok || typ != reflect.TypeFor[int64]() {
+		t.Fatalf("PayloadType(SessionId) = %v, %v", typ, ok)
+	}
+	if _, ok := PayloadType(BASettings); ok {
+		t.Fatal("an undeclared command has a payload type")
+	}
+
+	Typed[int64](SessionId)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("declaring SessionId as a string did not panic")
+		}
+	}()
+	Typed[string](SessionId)
+}
@@ -0,0 +1,133 @@
+package qws
+
+import (
+	"context"
+	"log"
+
+	"github.com/amh11706/logger"
+	"github.com/amh11706/qdb"
+	"github.com/amh11706/qsql"
+	"github.com/amh11706/qws/incmds"
+)
+
+// Reasons a route refuses a message. They are shown to the user.
+const (
+	DeniedAdmin    = "You do not have permission to do that."
+	DeniedGuest    = "Please log in to do that."
+	DeniedGhosted  = "You cannot do that while ghosted."
+	DeniedNotLobby = "You need to be in a lobby to do that."
+)
+
+type permissions struct {
+	minAdmin   AdminLevel
+	registered bool
+	notGhosted bool
+	inLobby    bool
+}
+
+// MinAdmin refuses the route to users below level.
+func MinAdmin(level AdminLevel) RouteOption {
+	return func(r *route) {
+		r.perms.minAdmin = level
+	}
+}
+
+// RegisteredOnly refuses the route to guests.
+func RegisteredOnly() RouteOption {
+	return func(r *route) {
+		r.perms.registered = true
+	}
+}
+
+// NotGhosted refuses the route to ghosted users.
+func NotGhosted() RouteOption {
+	return func(r *route) {
+		r.perms.notGhosted = true
+	}
+}
+
+// InLobbyOnly refuses the route to users that are not in a lobby.
+func InLobbyOnly() RouteOption {
+	return func(r *route) {
+		r.perms.inLobby = true
+	}
+}
+
+// check returns why c may not use the route, or "" if it may.
+func (p permissions) check(c *UserConn) string {
+	switch {
+	case c.AdminLevel() < p.minAdmin:
+		return DeniedAdmin
+	case p.registered && c.IsGuest():
+		return DeniedGuest
+	case p.notGhosted && c.IsGhosted():
+		return DeniedGhosted
+	case p.inLobby && c.InLobby() == 0:
+		return DeniedNotLobby
+	}
+	return ""
+}
+
+// guard wraps h with the permission checks, if there are any.
+func (p permissions) guard(h Handler) Handler {
+	if p == (permissions{}) {
+		return h
+	}
+	return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+		if reason := p.check(c); reason != "" {
+			deny(ctx, c, m, reason)
+			return
+		}
+		h.ServeWS(ctx, c, m)
+	})
+}
+
+// deny tells the client its message was refused, as a reply with a
+// CodeDenied Error when it has an Id, and records the attempt with Audit.
+func deny(ctx context.Context, c *UserConn, m *RawMessage, reason string) {
+	Audit.Denied(ctx, c, m.Cmd, reason)
+	if m.Id > 0 {
+		c.SendRaw(ctx, &Message{Id: m.Id, Error: NewError(CodeDenied, reason)})
+		m.Id = 0
+	} else {
+		c.SendInfo(ctx, reason)
+	}
+}
+
+// Auditor records messages that routes refused.
+type Auditor interface {
+	Denied(ctx context.Context, c *UserConn, cmd incmds.Cmd, reason string)
+}
+
+// Audit receives every refused message. It logs them by default.
+var Audit Auditor = logAuditor{}
+
+type logAuditor struct{}
+
+func (logAuditor) Denied(ctx context.Context, c *UserConn, cmd incmds.Cmd, reason string) {
+	log.Printf("\x1b[36m%s\x1b[0m denied cmd %d: %s\n", c.PrintName(), cmd, reason)
+}
+
+// DBAuditor writes refused messages to a table, like CommandLogger does for
+// chat commands.
+type DBAuditor struct {
+	table   qsql.Table
+	columns []string
+}
+
+func NewDBAuditor(tableName string) *DBAuditor {
+	return &DBAuditor{table: qsql.NewTable(&qdb.DB, tableName), columns: qsql.GetColumns(deniedLog{}, true)}
+}
+
+type deniedLog struct {
+	UserId  int64      `db:"user_id"`
+	LobbyId int64      `db:"lobby_id"`
+	Cmd     incmds.Cmd `db:"cmd"`
+	Reason  string     `db:"reason"`
+}
+
+func (a *DBAuditor) Denied(ctx context.Context, c *UserConn, cmd incmds.Cmd, reason string) {
+	entry := &deniedLog{UserId: c.UserId(), LobbyId: c.InLobby(), Cmd: cmd, Reason: reason}
+	_, err := a.table.Create(ctx, entry, a.columns...)
+	logger.Check(err)
+}
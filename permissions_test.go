@@ -0,0 +1,61 @@
+package qws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+type auditRecorder chan string
+
+func (a auditRecorder) Denied(ctx context.Context, c *UserConn, cmd incmds.Cmd, reason string) {
+	a <- reason
+}
+
+func TestRoutePermissionsDenyAndAudit(t *testing.T) {
+	audit := make(auditRecorder, 4)
+	defer func(old Auditor) { Audit = old }(Audit)
+	Audit = audit
+
+	b := NewBotConn(-1, &User{Name: "Guest"})
+	replies := b.Subscribe(0, 4)
+	b.Start(t.Context())
+	defer b.Close()
+
+	ran := 0
+	r := NewRouter()
+	HandleDynamic(r, incmds.MapSave, func(ctx context.Context, c UserConner, in string) string {
+		ran++
+		return "saved"
+	}, RegisteredOnly(), InLobbyOnly())
+
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapSave, Id: 7, Data: []byte(`"x"`)})
+	select {
+	case m := <-replies:
+		if m.Id != 7 || m.Error == nil || m.Error.Code != CodeDenied || m.Error.Message != DeniedGuest {
+			t.Fatalf("reply %d had error %+v", m.Id, m.Error)
+		}
+		if len(m.Data) != 0 && string(m.Data) != "null" {
+			t.Fatalf("denial also carried data %s", m.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("denied request got no reply")
+	}
+	if reason := <-audit; reason != DeniedGuest {
+		t.Fatalf("audited %q", reason)
+	}
+
+	b.User().Id = 5
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapSave, Data: []byte(`"x"`)})
+	if reason := <-audit; reason != DeniedNotLobby {
+		t.Fatalf("audited %q", reason)
+	}
+
+	b.SetInLobby(3)
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapSave, Data: []byte(`"x"`)})
+	if ran != 1 {
+		t.Fatalf("handler ran %d times, want once", ran)
+	}
+}
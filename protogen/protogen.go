@@ -0,0 +1,222 @@
+// Package protogen describes the qws protocol for the web client: the
+// incmds and outcmds enums, the types each HandleDynamic route takes and
+// replies with, and the payloads declared with outcmds.Typed. It writes them
+// as TypeScript and as JSON Schema.
+//
+// Only routes registered in the running process are known, so a server with
+// its own handlers should register them on a qws.NewRouter and then call
+// WriteFiles from its own binary.
+package protogen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/amh11706/qws"
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+)
+
+// EnumValue is one named command.
+type EnumValue struct {
+	Name  string
+	Value int64
+}
+
+// Route is every input and reply type registered for one incoming command.
+type Route struct {
+	Cmd EnumValue
+	In  []reflect.Type
+	Out []reflect.Type
+}
+
+// Payload is the type declared for one outgoing command.
+type Payload struct {
+	Cmd  EnumValue
+	Type reflect.Type
+}
+
+// Protocol is everything the generators write.
+type Protocol struct {
+	InCmds   []EnumValue
+	OutCmds  []EnumValue
+	Routes   []Route
+	Payloads []Payload
+}
+
+// Collect reads the command names from the incmds and outcmds sources and
+// the types from qws.DynamicRoutes and outcmds.PayloadTypes.
+func Collect() (*Protocol, error) {
+	in, err := ParseEnum(incmds.Source, "Cmd")
+	if err != nil {
+		return nil, fmt.Errorf("incmds: %w", err)
+	}
+	out, err := ParseEnum(outcmds.Source, "Cmd")
+	if err != nil {
+		return nil, fmt.Errorf("outcmds: %w", err)
+	}
+	p := &Protocol{InCmds: in, OutCmds: out}
+
+	byCmd := make(map[incmds.Cmd]*Route)
+	for _, rt := range qws.DynamicRoutes() {
+		r := byCmd[rt.Cmd]
+		if r == nil {
+			r = &Route{Cmd: enumValue(in, int64(rt.Cmd))}
+			byCmd[rt.Cmd] = r
+		}
+		r.In = appendType(r.In, rt.In)
+		r.Out = appendType(r.Out, rt.Out)
+	}
+	for _, r := range byCmd {
+		p.Routes = append(p.Routes, *r)
+	}
+	sort.Slice(p.Routes, func(i, j int) bool { return p.Routes[i].Cmd.Value < p.Routes[j].Cmd.Value })
+
+	for cmd, t := range outcmds.PayloadTypes() {
+		p.Payloads = append(p.Payloads, Payload{Cmd: enumValue(out, int64(cmd)), Type: t})
+	}
+	sort.Slice(p.Payloads, func(i, j int) bool { return p.Payloads[i].Cmd.Value < p.Payloads[j].Cmd.Value })
+	return p, nil
+}
+
+func appendType(ts []reflect.Type, t reflect.Type) []reflect.Type {
+	for _, have := range ts {
+		if have == t {
+			return ts
+		}
+	}
+	return append(ts, t)
+}
+
+// enumValue names value, or calls it Cmd<value> when the source has no name
+// for it.
+func enumValue(values []EnumValue, value int64) EnumValue {
+	for _, v := range values {
+		if v.Value == value {
+			return v
+		}
+	}
+	return EnumValue{Name: "Cmd" + strconv.FormatInt(value, 10), Value: value}
+}
+
+// WriteFiles collects the protocol and writes protocol.ts and
+// protocol.schema.json into dir.
+func WriteFiles(dir string) error {
+	p, err := Collect()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	ts, err := os.Create(filepath.Join(dir, "protocol.ts"))
+	if err != nil {
+		return err
+	}
+	defer ts.Close()
+	if err := p.WriteTypeScript(ts); err != nil {
+		return err
+	}
+	schema, err := os.Create(filepath.Join(dir, "protocol.schema.json"))
+	if err != nil {
+		return err
+	}
+	defer schema.Close()
+	if err := p.WriteSchema(schema); err != nil {
+		return err
+	}
+	if err := ts.Close(); err != nil {
+		return err
+	}
+	return schema.Close()
+}
+
+// ParseEnum returns the constants of type typeName declared in src, in
+// source order, following iota the way the compiler does.
+func ParseEnum(src, typeName string) ([]EnumValue, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	var values []EnumValue
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.CONST {
+			continue
+		}
+		var typ string
+		var expr ast.Expr
+		for i, spec := range gd.Specs {
+			vs := spec.(*ast.ValueSpec)
+			if len(vs.Values) > 0 {
+				// A spec without values repeats the type and value of the
+				// last one that had them.
+				expr = vs.Values[0]
+				typ = ""
+				if id, ok := vs.Type.(*ast.Ident); ok {
+					typ = id.Name
+				}
+			}
+			if typ != typeName || expr == nil {
+				continue
+			}
+			v, err := evalConst(expr, int64(i))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range vs.Names {
+				if name.Name != "_" {
+					values = append(values, EnumValue{Name: name.Name, Value: v})
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func evalConst(expr ast.Expr, iota int64) (int64, error) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind == token.INT {
+			return strconv.ParseInt(e.Value, 0, 64)
+		}
+	case *ast.Ident:
+		if e.Name == "iota" {
+			return iota, nil
+		}
+	case *ast.ParenExpr:
+		return evalConst(e.X, iota)
+	case *ast.UnaryExpr:
+		x, err := evalConst(e.X, iota)
+		if err == nil && e.Op == token.SUB {
+			return -x, nil
+		}
+	case *ast.BinaryExpr:
+		x, err := evalConst(e.X, iota)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evalConst(e.Y, iota)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.SHL:
+			return x << y, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported constant expression %T", expr)
+}
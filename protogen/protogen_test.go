@@ -0,0 +1,99 @@
+package protogen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/amh11706/qws"
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestParseEnumFollowsIota(t *testing.T) {
+	values, err := ParseEnum(`package x
+type Cmd int16
+const (
+	A Cmd = iota
+	B
+	_
+	C
+)
+const Other = 7
+const (
+	D Cmd = iota + 100
+	E
+)`, "Cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EnumValue{{"A", 0}, {"B", 1}, {"C", 3}, {"D", 100}, {"E", 101}}
+	if len(values) != len(want) {
+		t.Fatalf("got %v, want %v", values, want)
+	}
+	for i := range want {
+		if values[i] != want[i] {
+			t.Fatalf("got %v, want %v", values, want)
+		}
+	}
+}
+
+type genBase struct {
+	Id int64 `json:"id"`
+}
+
+type genMove struct {
+	genBase
+	Name  string   `json:"name,omitempty"`
+	Steps []uint8  `json:"steps"`
+	Moves [4]int   `json:"moves"`
+	Skip  string   `json:"-"`
+	Next  *genMove `json:"next"`
+}
+
+func TestWriteTypeScriptAndSchema(t *testing.T) {
+	qws.HandleDynamic(qws.NewRouter(), incmds.Moves, func(ctx context.Context, c qws.UserConner, in genMove) []string {
+		return nil
+	})
+	p, err := Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	if err := p.WriteTypeScript(b); err != nil {
+		t.Fatal(err)
+	}
+	ts := b.String()
+	for _, want := range []string{
+		"  LobbyCmds = 100,\n",
+		"export interface genMove {\n  id: number;\n  name?: string;\n  steps: string;\n  moves: number[];\n  next: genMove | null;\n}\n",
+		"  [InCmd.Moves]: genMove;\n",
+		"  [InCmd.Moves]: string[];\n",
+		"  [OutCmd.SessionResume]: SessionInfo | null;\n",
+		"export interface Qws_Error {\n  code: string;\n  message: string;\n  details?: unknown;\n}\n",
+	} {
+		if !strings.Contains(ts, want) {
+			t.Errorf("TypeScript is missing %q:\n%s", want, ts)
+		}
+	}
+
+	b.Reset()
+	if err := p.WriteSchema(b); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Defs map[string]map[string]interface{} `json:"$defs"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if ref := doc.Defs["in.Moves"]["$ref"]; ref != "#/$defs/genMove" {
+		t.Fatalf("in.Moves refers to %v", ref)
+	}
+	required := doc.Defs["genMove"]["required"].([]interface{})
+	if len(required) != 4 || required[0] != "id" {
+		t.Fatalf("genMove requires %v", required)
+	}
+}
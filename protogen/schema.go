@@ -0,0 +1,114 @@
+package protogen
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+// WriteSchema writes a JSON Schema document whose $defs hold the enums InCmd
+// and OutCmd, every struct in the protocol by name, and each command's
+// payload as in.<Cmd>, reply.<Cmd> and out.<Cmd>.
+func (p *Protocol) WriteSchema(w io.Writer) error {
+	ts := newTypes(p)
+	defs := map[string]interface{}{
+		"InCmd":  enumSchema(p.InCmds),
+		"OutCmd": enumSchema(p.OutCmds),
+	}
+	for _, t := range ts.order {
+		defs[ts.names[t]] = ts.schemaObject(t)
+	}
+	for _, r := range p.Routes {
+		defs["in."+r.Cmd.Name] = ts.schemaUnion(r.In)
+		defs["reply."+r.Cmd.Name] = ts.schemaUnion(r.Out)
+	}
+	for _, pl := range p.Payloads {
+		defs["out."+pl.Cmd.Name] = ts.schemaType(pl.Type)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$defs":   defs,
+	})
+}
+
+type schema = map[string]interface{}
+
+func enumSchema(values []EnumValue) schema {
+	oneOf := make([]schema, len(values))
+	for i, v := range values {
+		oneOf[i] = schema{"const": v.Value, "title": v.Name}
+	}
+	return schema{"type": "integer", "oneOf": oneOf}
+}
+
+func (ts *types) schemaUnion(types []reflect.Type) schema {
+	if len(types) == 1 {
+		return ts.schemaType(types[0])
+	}
+	anyOf := make([]schema, len(types))
+	for i, t := range types {
+		anyOf[i] = ts.schemaType(t)
+	}
+	return schema{"anyOf": anyOf}
+}
+
+func (ts *types) schemaType(t reflect.Type) schema {
+	if t == timeType {
+		return schema{"type": "string", "format": "date-time"}
+	}
+	if opaque(t) {
+		return schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Pointer:
+		return schema{"anyOf": []schema{ts.schemaType(t.Elem()), {"type": "null"}}}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return schema{"type": "array", "items": ts.schemaType(t.Elem())}
+	case reflect.Array:
+		return schema{"type": "array", "items": ts.schemaType(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": ts.schemaType(t.Elem())}
+	case reflect.Struct:
+		if name, ok := ts.names[t]; ok {
+			return schema{"$ref": "#/$defs/" + name}
+		}
+		return ts.schemaObject(t)
+	}
+	return schema{}
+}
+
+func (ts *types) schemaObject(t reflect.Type) schema {
+	props := schema{}
+	var required []string
+	for _, f := range fields(t) {
+		if f.asString {
+			props[f.name] = schema{"type": "string"}
+		} else {
+			props[f.name] = ts.schemaType(f.typ)
+		}
+		if !f.optional {
+			required = append(required, f.name)
+		}
+	}
+	s := schema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
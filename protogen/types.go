@@ -0,0 +1,203 @@
+package protogen
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/amh11706/qws"
+)
+
+var (
+	marshalerType = reflect.TypeFor[json.Marshaler]()
+	timeType      = reflect.TypeFor[time.Time]()
+	errorType     = reflect.TypeFor[qws.Error]()
+)
+
+// types names the struct types reachable from the protocol so both
+// generators refer to them the same way.
+type types struct {
+	names map[reflect.Type]string
+	taken map[string]bool
+	order []reflect.Type
+}
+
+// tsGlobals are TypeScript's built-in types, which a type of the same name
+// would shadow for the client.
+var tsGlobals = []string{"Array", "Boolean", "Date", "Error", "Function", "Map", "Number", "Object", "Promise", "Record", "Set", "String"}
+
+func newTypes(p *Protocol) *types {
+	ts := &types{names: make(map[reflect.Type]string), taken: make(map[string]bool)}
+	for _, name := range tsGlobals {
+		ts.taken[name] = true
+	}
+	for _, r := range p.Routes {
+		for _, t := range r.In {
+			ts.visit(t)
+		}
+		for _, t := range r.Out {
+			ts.visit(t)
+		}
+	}
+	for _, pl := range p.Payloads {
+		ts.visit(pl.Type)
+	}
+	// Any reply can carry an error instead of its data.
+	ts.visit(errorType)
+	return ts
+}
+
+// opaque reports whether t encodes itself, so its shape cannot be known from
+// its fields.
+func opaque(t reflect.Type) bool {
+	return t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType)
+}
+
+func (ts *types) visit(t reflect.Type) {
+	if t == timeType || opaque(t) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		ts.visit(t.Elem())
+	case reflect.Map:
+		ts.visit(t.Elem())
+	case reflect.Struct:
+		if t.Name() != "" {
+			if _, ok := ts.names[t]; ok {
+				return
+			}
+			ts.names[t] = ts.newName(t)
+			ts.order = append(ts.order, t)
+		}
+		for _, f := range fields(t) {
+			ts.visit(f.typ)
+		}
+	}
+}
+
+// newName turns t's Go name into an identifier, qualifying it with its
+// package when another package already has a type of that name or it is a
+// TypeScript global.
+func (ts *types) newName(t reflect.Type) string {
+	name := identifier(t.Name())
+	if ts.taken[name] {
+		pkg := t.PkgPath()
+		pkg = pkg[strings.LastIndex(pkg, "/")+1:] + "_"
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+		for base, i := name, 2; ts.taken[name]; i++ {
+			name = base + strconv.Itoa(i)
+		}
+	}
+	ts.taken[name] = true
+	return name
+}
+
+// identifier turns a generic type's name into one TypeScript accepts, so
+// UserList[*github.com/amh11706/qws.UserConn] becomes UserList_UserConn.
+func identifier(s string) string {
+	base, args, generic := strings.Cut(s, "[")
+	if !generic {
+		return base
+	}
+	parts := []string{base}
+	for _, arg := range strings.FieldsFunc(args, func(r rune) bool {
+		return r == ',' || r == '[' || r == ']'
+	}) {
+		arg = arg[strings.LastIndexAny(arg, "./")+1:]
+		arg = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+				return r
+			}
+			return -1
+		}, arg)
+		if arg != "" {
+			parts = append(parts, arg)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// field is a struct field as encoding/json sees it.
+type field struct {
+	name     string
+	typ      reflect.Type
+	optional bool
+	asString bool
+	depth    int
+}
+
+// fields follows encoding/json: tags rename or skip fields, embedded structs
+// without a tag have their fields promoted, and the shallowest field of a
+// name wins.
+func fields(t reflect.Type) []field {
+	var out []field
+	collectFields(t, 0, &out, map[reflect.Type]bool{})
+	index := make(map[string]int)
+	var kept []field
+	for _, f := range out {
+		if i, ok := index[f.name]; ok {
+			if f.depth < kept[i].depth {
+				kept[i] = f
+			}
+			continue
+		}
+		index[f.name] = len(kept)
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+func collectFields(t reflect.Type, depth int, out *[]field, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			et := ft
+			if et.Kind() == reflect.Pointer {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				collectFields(et, depth+1, out, seen)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		*out = append(*out, field{
+			name:     name,
+			typ:      ft,
+			optional: hasOpt(opts, "omitempty") || hasOpt(opts, "omitzero"),
+			asString: hasOpt(opts, "string"),
+			depth:    depth,
+		})
+	}
+}
+
+func hasOpt(opts, opt string) bool {
+	for opts != "" {
+		var o string
+		o, opts, _ = strings.Cut(opts, ",")
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package protogen
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// WriteTypeScript writes the enums InCmd and OutCmd, an interface for every
+// struct in the protocol including qws.Error, and the maps InData, InReply and OutData from each
+// command to its payload type.
+func (p *Protocol) WriteTypeScript(w io.Writer) error {
+	ts := newTypes(p)
+	b := &strings.Builder{}
+	b.WriteString("// Code generated by qwsgen. DO NOT EDIT.\n")
+
+	writeTSEnum(b, "InCmd", p.InCmds)
+	writeTSEnum(b, "OutCmd", p.OutCmds)
+
+	for _, t := range ts.order {
+		fmt.Fprintf(b, "\nexport interface %s {\n", ts.names[t])
+		for _, f := range fields(t) {
+			opt := ""
+			if f.optional {
+				opt = "?"
+			}
+			typ := "string"
+			if !f.asString {
+				typ = ts.tsType(f.typ)
+			}
+			fmt.Fprintf(b, "  %s%s: %s;\n", tsKey(f.name), opt, typ)
+		}
+		b.WriteString("}\n")
+	}
+
+	b.WriteString("\nexport interface InData {\n")
+	for _, r := range p.Routes {
+		fmt.Fprintf(b, "  [InCmd.%s]: %s;\n", r.Cmd.Name, ts.tsUnion(r.In))
+	}
+	b.WriteString("}\n\nexport interface InReply {\n")
+	for _, r := range p.Routes {
+		fmt.Fprintf(b, "  [InCmd.%s]: %s;\n", r.Cmd.Name, ts.tsUnion(r.Out))
+	}
+	b.WriteString("}\n\nexport interface OutData {\n")
+	for _, pl := range p.Payloads {
+		fmt.Fprintf(b, "  [OutCmd.%s]: %s;\n", pl.Cmd.Name, ts.tsType(pl.Type))
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeTSEnum(b *strings.Builder, name string, values []EnumValue) {
+	fmt.Fprintf(b, "\nexport enum %s {\n", name)
+	for _, v := range values {
+		fmt.Fprintf(b, "  %s = %d,\n", v.Name, v.Value)
+	}
+	b.WriteString("}\n")
+}
+
+func (ts *types) tsUnion(types []reflect.Type) string {
+	parts := make([]string, len(types))
+	for i, t := range types {
+		parts[i] = ts.tsType(t)
+	}
+	return strings.Join(parts, " | ")
+}
+
+func (ts *types) tsType(t reflect.Type) string {
+	if t == timeType {
+		return "string"
+	}
+	if opaque(t) {
+		return "unknown"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Pointer:
+		return ts.tsType(t.Elem()) + " | null"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json writes byte slices as base64.
+			return "string"
+		}
+		return tsArray(ts.tsType(t.Elem()))
+	case reflect.Array:
+		return tsArray(ts.tsType(t.Elem()))
+	case reflect.Map:
+		return "Record<string, " + ts.tsType(t.Elem()) + ">"
+	case reflect.Struct:
+		if name, ok := ts.names[t]; ok {
+			return name
+		}
+		parts := []string{}
+		for _, f := range fields(t) {
+			opt := ""
+			if f.optional {
+				opt = "?"
+			}
+			parts = append(parts, tsKey(f.name)+opt+": "+ts.tsType(f.typ))
+		}
+		if len(parts) == 0 {
+			return "Record<string, never>"
+		}
+		return "{ " + strings.Join(parts, "; ") + " }"
+	}
+	return "unknown"
+}
+
+func tsArray(elem string) string {
+	if strings.Contains(elem, " ") {
+		return "(" + elem + ")[]"
+	}
+	return elem + "[]"
+}
+
+// tsKey quotes field names that are not identifiers.
+func tsKey(name string) string {
+	for i, r := range name {
+		if !(r == '_' || r == '$' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || i > 0 && '0' <= r && r <= '9') {
+			return strconv.Quote(name)
+		}
+	}
+	if name == "" {
+		return `""`
+	}
+	return name
+}
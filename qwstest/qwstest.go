@@ -0,0 +1,257 @@
+// Package qwstest runs UserConns over an in-memory transport, so handlers can
+// be driven and their replies checked without a network.
+package qwstest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws"
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+)
+
+// Timeout is how long Expect waits for a message before failing the test.
+var Timeout = time.Second
+
+// Message is an outbound message as the client decoded it.
+type Message struct {
+	Cmd  outcmds.Cmd     `json:"cmd"`
+	Id   uint32          `json:"id"`
+	Data json.RawMessage `json:"data"`
+	// Error is set when the message is the failed reply to a request.
+	Error *qws.Error `json:"error,omitempty"`
+	// More is set on partial results, see qws.SendPartial.
+	More bool `json:"more,omitempty"`
+}
+
+// wireMessage is an inbound frame before it is encoded.
+type wireMessage struct {
+	Cmd  incmds.Cmd  `json:"cmd,omitempty"`
+	Id   uint32      `json:"id,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Client is the far end of an in-memory connection to Conn.
+type Client struct {
+	Conn     *qws.UserConn
+	t        testing.TB
+	codec    qws.Codec
+	end      *qws.PipeEnd
+	received chan *Message
+	pending  []*Message
+	nextId   uint32
+	chunks   qws.ChunkAssembler
+	// nextStream numbers the messages sent with SendChunked.
+	nextStream uint32
+}
+
+// NewClient connects a JSON client to a new UserConn for user, or for a guest
+// if user is nil. The connection is reading and writing when this returns and
+// is closed when the test ends.
+func NewClient(t testing.TB, user *qws.User) *Client {
+	return NewClientCodec(t, user, qws.JSONCodec)
+}
+
+func NewClientCodec(t testing.TB, user *qws.User, codec qws.Codec) *Client {
+	t.Helper()
+	if user == nil {
+		user = qws.NewGuest()
+	}
+	server, end := qws.Pipe(codec)
+	c := &Client{
+		Conn:     qws.NewTransportUserConn(user, server, "127.0.0.1"),
+		t:        t,
+		codec:    codec,
+		end:      end,
+		received: make(chan *Message, 256),
+	}
+	ctx := t.Context()
+	c.Conn.ListenWrite(ctx)
+	go func() {
+		c.Conn.ListenRead(ctx)
+		c.Conn.Disconnect()
+	}()
+	go c.readLoop()
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *Client) readLoop() {
+	defer close(c.received)
+	for {
+		_, b, err := c.end.ReadMessage()
+		if err != nil {
+			return
+		}
+		m, err := c.decode(b)
+		if err == nil && m.Cmd == outcmds.Chunk {
+			m, err = c.assemble(m)
+		}
+		if err != nil {
+			c.t.Errorf("qwstest: undecodable message %q: %v", b, err)
+			return
+		}
+		if m != nil {
+			c.received <- m
+		}
+	}
+}
+
+func (c *Client) decode(b []byte) (*Message, error) {
+	m, err := qws.DecodeClientMessage(c.codec, b, c.Conn.FetchKey())
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Cmd: m.Cmd, Id: m.Id, Data: m.Data, Error: m.Error, More: m.More}, nil
+}
+
+// assemble adds a chunk and decodes the message it completes, if any.
+func (c *Client) assemble(m *Message) (*Message, error) {
+	ch := &qws.Chunk{}
+	if err := json.Unmarshal(m.Data, ch); err != nil {
+		return nil, err
+	}
+	full, err := c.chunks.Add(ch)
+	if err != nil || full == nil {
+		return nil, err
+	}
+	return c.decode(full)
+}
+
+// SendChunked delivers a message split into chunks of size bytes.
+func (c *Client) SendChunked(cmd incmds.Cmd, data interface{}, size int) {
+	c.t.Helper()
+	b, err := c.codec.Marshal(&wireMessage{Cmd: cmd, Data: data})
+	if err != nil {
+		c.t.Fatalf("qwstest: encode %d: %v", cmd, err)
+	}
+	c.nextStream++
+	total := (len(b) + size - 1) / size
+	for seq := 0; seq < total; seq++ {
+		part := b[seq*size : min((seq+1)*size, len(b))]
+		c.send(incmds.Chunk, 0, &qws.Chunk{Stream: c.nextStream, Seq: seq, Total: total, Data: part})
+	}
+}
+
+// Send delivers a message to the connection as if the client had sent it.
+func (c *Client) Send(cmd incmds.Cmd, data interface{}) {
+	c.t.Helper()
+	c.send(cmd, 0, data)
+}
+
+// Request sends a message with a fresh Id and returns that Id, for use with
+// ExpectReply.
+func (c *Client) Request(cmd incmds.Cmd, data interface{}) uint32 {
+	c.t.Helper()
+	c.nextId++
+	c.send(cmd, c.nextId, data)
+	return c.nextId
+}
+
+// Reply answers a request the server made with UserConn.Request.
+func (c *Client) Reply(id uint32, data interface{}) {
+	c.t.Helper()
+	c.send(incmds.Reply, id, data)
+}
+
+// Cancel asks the server to stop the request with id and not reply to it.
+func (c *Client) Cancel(id uint32) {
+	c.t.Helper()
+	c.send(incmds.Cancel, id, nil)
+}
+
+// ExpectRequest waits for the server to make a request under cmd.
+func (c *Client) ExpectRequest(cmd outcmds.Cmd) *Message {
+	c.t.Helper()
+	return c.expect(func(m *Message) bool { return m.Id != 0 && m.Cmd == cmd }, "request %d", cmd)
+}
+
+func (c *Client) send(cmd incmds.Cmd, id uint32, data interface{}) {
+	c.t.Helper()
+	b, err := c.codec.Marshal(&wireMessage{Cmd: cmd, Id: id, Data: data})
+	if err != nil {
+		c.t.Fatalf("qwstest: encode %d: %v", cmd, err)
+	}
+	if err := c.end.WriteMessage(c.codec.FrameType(), b); err != nil {
+		c.t.Fatalf("qwstest: send %d: %v", cmd, err)
+	}
+}
+
+// Expect waits for the next message with cmd. Messages of other commands
+// that arrive first are kept for later Expect calls.
+func (c *Client) Expect(cmd outcmds.Cmd) *Message {
+	c.t.Helper()
+	return c.expect(func(m *Message) bool { return m.Id == 0 && m.Cmd == cmd }, "cmd %d", cmd)
+}
+
+// ExpectReply waits for the reply to the request with the given Id. Partial
+// results count as replies, so call it until one arrives without More.
+func (c *Client) ExpectReply(id uint32) *Message {
+	c.t.Helper()
+	return c.expect(func(m *Message) bool { return m.Id == id }, "reply to id %d", id)
+}
+
+// ExpectNone fails the test if a message with cmd arrives within d.
+func (c *Client) ExpectNone(cmd outcmds.Cmd, d time.Duration) {
+	c.t.Helper()
+	for _, m := range c.pending {
+		if m.Cmd == cmd {
+			c.t.Fatalf("qwstest: unexpected cmd %d: %s", cmd, m.Data)
+		}
+	}
+	deadline := time.After(d)
+	for {
+		select {
+		case m, ok := <-c.received:
+			if !ok {
+				return
+			}
+			if m.Cmd == cmd {
+				c.t.Fatalf("qwstest: unexpected cmd %d: %s", cmd, m.Data)
+			}
+			c.pending = append(c.pending, m)
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func (c *Client) expect(match func(*Message) bool, format string, args ...interface{}) *Message {
+	c.t.Helper()
+	for i, m := range c.pending {
+		if match(m) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return m
+		}
+	}
+	deadline := time.After(Timeout)
+	for {
+		select {
+		case m, ok := <-c.received:
+			if !ok {
+				c.t.Fatalf("qwstest: connection closed waiting for "+format, args...)
+			}
+			if match(m) {
+				return m
+			}
+			c.pending = append(c.pending, m)
+		case <-deadline:
+			c.t.Fatalf("qwstest: timed out waiting for "+format, args...)
+		}
+	}
+}
+
+// Close drops the client's end, as a client closing its socket would.
+func (c *Client) Close() {
+	c.end.Close()
+}
+
+// Decode unmarshals the message data into v, failing the test on error.
+func (m *Message) Decode(t testing.TB, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		t.Fatalf("qwstest: decode cmd %d: %s: %v", m.Cmd, m.Data, err)
+	}
+}
@@ -0,0 +1,153 @@
+package qwstest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws"
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+)
+
+type echoIn struct {
+	Text string `json:"text"`
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	for _, codec := range []qws.Codec{qws.JSONCodec, qws.MsgpackCodec, qws.CBORCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			c := NewClientCodec(t, nil, codec)
+			qws.HandleDynamic(c.Conn.Router(), incmds.SearchNames, func(ctx context.Context, c qws.UserConner, in echoIn) []string {
+				return []string{in.Text, in.Text}
+			})
+			c.Conn.Router().HandleFunc(incmds.ChatCommand, func(ctx context.Context, uc *qws.UserConn, m *qws.RawMessage) {
+				uc.SendInfo(ctx, "pong")
+			})
+
+			id := c.Request(incmds.SearchNames, echoIn{Text: "a"})
+			var names []string
+			c.ExpectReply(id).Decode(t, &names)
+			if len(names) != 2 || names[0] != "a" {
+				t.Fatalf("reply = %v", names)
+			}
+
+			c.Send(incmds.ChatCommand, "/ping")
+			var info qws.Info
+			c.Expect(outcmds.ChatMessage).Decode(t, &info)
+			if info.Message != "pong" {
+				t.Fatalf("info = %q", info.Message)
+			}
+		})
+	}
+}
+
+func TestClientFetchesOffloadedMessages(t *testing.T) {
+	c := NewClient(t, nil)
+	var key string
+	c.Expect(outcmds.FetchKeyCmd.Cmd).Decode(t, &key)
+	if key == "" || key != c.Conn.FetchKey() {
+		t.Fatalf("fetch key = %q, want %q", key, c.Conn.FetchKey())
+	}
+	big := make([]int, qws.MaxJsonSize)
+	c.Conn.Send(t.Context(), outcmds.Sync, big)
+
+	var got []int
+	c.Expect(outcmds.Sync).Decode(t, &got)
+	if len(got) != len(big) {
+		t.Fatalf("offloaded message decoded to %d items, want %d", len(got), len(big))
+	}
+}
+
+func TestChunkedClientGetsLargeMessagesAfterGameTraffic(t *testing.T) {
+	c := NewClient(t, nil)
+	c.Conn.SetChunked(true)
+	big := make([]int, qws.MaxJsonSize)
+	offloads := qws.Offloads.Stats().Stored
+
+	c.Conn.Send(t.Context(), outcmds.Sync, big)
+	c.Conn.Send(t.Context(), outcmds.BoatTick, 1)
+	c.Expect(outcmds.BoatTick)
+	var got []int
+	c.Expect(outcmds.Sync).Decode(t, &got)
+	if len(got) != len(big) {
+		t.Fatalf("chunked message decoded to %d items, want %d", len(got), len(big))
+	}
+	if qws.Offloads.Stats().Stored != offloads {
+		t.Fatal("a chunked client's message was offloaded as well")
+	}
+}
+
+func TestServerReassemblesChunkedUploads(t *testing.T) {
+	for _, codec := range []qws.Codec{qws.JSONCodec, qws.MsgpackCodec, qws.CBORCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			c := NewClientCodec(t, nil, codec)
+			saved := make(chan int, 1)
+			qws.HandleDynamic(c.Conn.Router(), incmds.MapSave, func(ctx context.Context, u qws.UserConner, in []int) string {
+				saved <- len(in)
+				return ""
+			})
+			c.SendChunked(incmds.MapSave, make([]int, 50000), 4096)
+			select {
+			case n := <-saved:
+				if n != 50000 {
+					t.Fatalf("handler got %d items", n)
+				}
+			case <-time.After(Timeout):
+				t.Fatal("chunked upload was not dispatched")
+			}
+		})
+	}
+}
+
+func TestPartialResultsThenReply(t *testing.T) {
+	c := NewClient(t, nil)
+	qws.HandleDynamic(c.Conn.Router(), incmds.StatsTop, func(ctx context.Context, uc qws.UserConner, pages int) string {
+		for i := 0; i < pages; i++ {
+			if err := qws.SendPartial(ctx, i); err != nil {
+				t.Error(err)
+			}
+		}
+		return "done"
+	})
+
+	id := c.Request(incmds.StatsTop, 2)
+	for i := 0; i < 2; i++ {
+		m := c.ExpectReply(id)
+		var page int
+		m.Decode(t, &page)
+		if !m.More || page != i {
+			t.Fatalf("partial %d was %s with More %v", i, m.Data, m.More)
+		}
+	}
+	var final string
+	m := c.ExpectReply(id)
+	m.Decode(t, &final)
+	if m.More || final != "done" {
+		t.Fatalf("final reply was %s with More %v", m.Data, m.More)
+	}
+}
+
+func TestCancelStopsHandlerAndReply(t *testing.T) {
+	c := NewClient(t, nil)
+	started, stopped := make(chan struct{}), make(chan error, 1)
+	qws.HandleDynamic(c.Conn.Router(), incmds.MatchData, func(ctx context.Context, uc qws.UserConner, in int) string {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return "too late"
+	})
+
+	id := c.Request(incmds.MatchData, 1)
+	<-started
+	c.Cancel(id)
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Fatalf("handler stopped with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel did not reach the handler")
+	}
+	c.ExpectNone(0, 50*time.Millisecond)
+}
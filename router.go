@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/amh11706/logger"
 	"github.com/amh11706/qws/incmds"
@@ -21,63 +24,145 @@ func (f HandlerFunc) ServeWS(ctx context.Context, c *UserConn, m *RawMessage) {
 }
 
 type Router struct {
-	routes map[incmds.Cmd]Handler
-	lock   sync.Mutex
+	// Name tells routers apart in logs and introspection.
+	Name string
+
+	table atomic.Pointer[routeTable]
+	// lock is held by changes to table, so they do not overwrite each other.
+	lock sync.Mutex
+}
+
+type route struct {
+	handler    Handler
+	concurrent bool
+	middleware []Middleware
+	perms      permissions
+	strict     bool
+	timeout    time.Duration
+	idem       *idempotency
+}
+
+// wrap applies the route's options and then the router's middleware to its
+// handler.
+func (rt *route) wrap(r *Router, mw []Middleware) Handler {
+	return chain(rt.perms.guard(rt.idem.guard(rt.withBudget(r, chain(rt.handler, rt.middleware)))), mw)
+}
+
+// RouteOption configures a single route when it is registered.
+type RouteOption func(*route)
+
+// Concurrent lets a route's messages be handled alongside the connection's
+// other messages. By default a connection's messages are handled one at a
+// time in the order they arrived, so only opt in for handlers that do not care
+// what ran before them, like list or stats lookups.
+func Concurrent() RouteOption {
+	return func(r *route) {
+		r.concurrent = true
+	}
+}
+
+func (r *Router) lookup(cmd incmds.Cmd) *route {
+	return r.load().lookup(cmd)
+}
+
+func (t *routeTable) lookup(cmd incmds.Cmd) *route {
+	if rt := t.routes[cmd]; rt != nil {
+		return rt
+	}
+	for _, m := range t.mounts {
+		if m.Contains(cmd) {
+			return m.route
+		}
+	}
+	return nil
+}
+
+// isConcurrent reports whether cmd was registered with Concurrent, following
+// mounts into nested Routers.
+func (r *Router) isConcurrent(cmd incmds.Cmd) bool {
+	if r == nil {
+		return false
+	}
+	rt := r.lookup(cmd)
+	if rt == nil {
+		return false
+	}
+	if nested, ok := rt.handler.(*Router); ok && nested != r {
+		return rt.concurrent || nested.isConcurrent(cmd)
+	}
+	return rt.concurrent
 }
 
 func (r *Router) ServeWS(ctx context.Context, c *UserConn, m *RawMessage) {
-	if r.routes == nil {
+	t := r.load()
+	if t.empty() {
 		log.Println("No assigned handlers for user", c.UserId())
 		return
 	}
 
-	cmd := m.Cmd
-	r.lock.Lock()
-	if cmd > incmds.LobbyCmds && r.routes[incmds.LobbyCmds] != nil {
-		cmd = incmds.LobbyCmds
-	}
-	if handler := r.routes[cmd]; handler != nil {
-		r.lock.Unlock()
-		handler.ServeWS(ctx, c, m)
+	if rt := t.lookup(m.Cmd); rt != nil {
+		ctx = withRouter(ctx, r)
+		if rt.strict {
+			ctx = withStrict(ctx)
+		}
+		t.handlers[rt].ServeWS(ctx, c, m)
 		if m.Id > 0 {
 			logger.Error("Sent missed return id for message:", m)
 			c.SendRaw(ctx, &Message{Id: m.Id})
 			m.Id = 0
 		}
 	} else {
-		log.Println("No matching handlers for user", c.UserId(), "and cmd", m.Cmd)
-		fmt.Println(r.routes)
-		r.lock.Unlock()
+		log.Printf("No matching handlers for user %d and cmd %d on router %q, see Router.Routes\n", c.UserId(), m.Cmd, r.Name)
 	}
 }
 
-func (r *Router) HandleFunc(command incmds.Cmd, h HandlerFunc) error {
-	return r.Handle(command, HandlerFunc(h))
+func (r *Router) HandleFunc(command incmds.Cmd, h HandlerFunc, opts ...RouteOption) error {
+	return r.Handle(command, HandlerFunc(h), opts...)
 }
 
-func (r *Router) Handle(command incmds.Cmd, h Handler) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	if r.routes == nil {
-		r.routes = make(map[incmds.Cmd]Handler)
-	} else if _, set := r.routes[command]; set {
-		return fmt.Errorf("AddCommand: command already registered: %d", command)
+// Handle routes command to h. Handling incmds.LobbyCmds mounts h on
+// LobbyRange instead.
+func (r *Router) Handle(command incmds.Cmd, h Handler, opts ...RouteOption) error {
+	if command == incmds.LobbyCmds {
+		return r.Mount(LobbyRange.Lo, LobbyRange.Hi, h, opts...)
 	}
-	r.routes[command] = h
-	return nil
+	rt := &route{handler: h}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return r.write(func(t *routeTable) error {
+		if t.routes == nil {
+			t.routes = make(map[incmds.Cmd]*route)
+		} else if _, set := t.routes[command]; set {
+			return fmt.Errorf("AddCommand: command already registered: %d", command)
+		}
+		t.routes[command] = rt
+		return nil
+	})
 }
 
-func HandleDynamic[T any, R any](r *Router, command incmds.Cmd, h DynamicFunc[T, R]) error {
-	return r.Handle(command, NewDynamicHandler(h))
+func HandleDynamic[T any, R any](r *Router, command incmds.Cmd, h DynamicFunc[T, R], opts ...RouteOption) error {
+	recordDynamicRoute(DynamicRoute{Cmd: command, In: reflect.TypeFor[T](), Out: reflect.TypeFor[R]()})
+	return r.Handle(command, NewDynamicHandler(h), opts...)
+}
+
+func HandleDynamicErr[T any, R any](r *Router, command incmds.Cmd, h DynamicErrFunc[T, R], opts ...RouteOption) error {
+	recordDynamicRoute(DynamicRoute{Cmd: command, In: reflect.TypeFor[T](), Out: reflect.TypeFor[R]()})
+	return r.Handle(command, NewDynamicErrHandler(h), opts...)
 }
 
 func (r *Router) RemoveCommand(command incmds.Cmd) {
 	if r == nil {
 		return
 	}
-	r.lock.Lock()
-	delete(r.routes, command)
-	r.lock.Unlock()
+	if command == incmds.LobbyCmds {
+		r.Unmount(LobbyRange.Lo)
+		return
+	}
+	r.write(func(t *routeTable) error {
+		delete(t.routes, command)
+		return nil
+	})
 }
 
 func NewRouter() *Router {
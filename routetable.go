@@ -0,0 +1,109 @@
+package qws
+
+import (
+	"maps"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+// routeTable is everything a Router routes by. A table is never changed once
+// it is stored, so messages are routed without taking a lock; changes copy
+// the table and swap the copy in.
+type routeTable struct {
+	routes     map[incmds.Cmd]*route
+	mounts     []*mount
+	middleware []Middleware
+	// handlers are the routes wrapped in their options and the router's
+	// middleware, built once when the table is stored.
+	handlers map[*route]Handler
+}
+
+var emptyTable = &routeTable{}
+
+func (t *routeTable) clone() *routeTable {
+	return &routeTable{
+		routes:     maps.Clone(t.routes),
+		mounts:     append([]*mount(nil), t.mounts...),
+		middleware: append([]Middleware(nil), t.middleware...),
+	}
+}
+
+// build wraps every route of t for r.
+func (t *routeTable) build(r *Router) {
+	t.handlers = make(map[*route]Handler, len(t.routes)+len(t.mounts))
+	for _, rt := range t.routes {
+		t.handlers[rt] = rt.wrap(r, t.middleware)
+	}
+	for _, m := range t.mounts {
+		t.handlers[m.route] = m.route.wrap(r, t.middleware)
+	}
+}
+
+func (t *routeTable) empty() bool {
+	return len(t.routes) == 0 && len(t.mounts) == 0
+}
+
+// load returns the current table.
+func (r *Router) load() *routeTable {
+	if t := r.table.Load(); t != nil {
+		return t
+	}
+	return emptyTable
+}
+
+// write applies fn to a copy of the table and stores the copy, unless fn
+// fails.
+func (r *Router) write(fn func(t *routeTable) error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	t := r.load().clone()
+	if err := fn(t); err != nil {
+		return err
+	}
+	t.build(r)
+	r.table.Store(t)
+	return nil
+}
+
+// Update registers routes in one change: fn makes its changes on tx, a
+// Router holding a copy of r's routes, and they replace r's routes all at
+// once when fn returns. If fn returns an error r is left as it was. Messages
+// routed meanwhile see either all of the changes or none of them.
+//
+// fn must only change tx. Changing r itself would wait for Update to return.
+func (r *Router) Update(fn func(tx *Router) error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	tx := &Router{Name: r.Name}
+	tx.table.Store(r.load().clone())
+	if err := fn(tx); err != nil {
+		return err
+	}
+	t := tx.load().clone()
+	t.build(r)
+	r.table.Store(t)
+	return nil
+}
+
+// Replace swaps out every route and mount within lo to hi for the ones fn
+// registers, as one Update. Moving a user between lobbies this way never
+// leaves a moment where neither lobby's commands are routed.
+func (r *Router) Replace(lo, hi incmds.Cmd, fn func(tx *Router) error) error {
+	cmds := CmdRange{lo, hi}
+	return r.Update(func(tx *Router) error {
+		tx.write(func(t *routeTable) error {
+			maps.DeleteFunc(t.routes, func(cmd incmds.Cmd, _ *route) bool {
+				return cmds.Contains(cmd)
+			})
+			mounts := t.mounts[:0]
+			for _, m := range t.mounts {
+				if m.Hi < lo || hi < m.Lo {
+					mounts = append(mounts, m)
+				}
+			}
+			t.mounts = mounts
+			return nil
+		})
+		return fn(tx)
+	})
+}
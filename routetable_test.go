@@ -0,0 +1,107 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestUpdateIsAllOrNothing(t *testing.T) {
+	nop := HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {})
+	r := NewRouter()
+	r.Handle(incmds.StatsTop, nop)
+
+	err := r.Update(func(tx *Router) error {
+		tx.Handle(incmds.StatsUser, nop)
+		return tx.Handle(incmds.StatsTop, nop)
+	})
+	if err == nil || r.lookup(incmds.StatsUser) != nil {
+		t.Fatalf("failed update left its routes behind: %v", err)
+	}
+
+	err = r.Update(func(tx *Router) error {
+		tx.RemoveCommand(incmds.StatsTop)
+		tx.Handle(incmds.StatsUser, nop)
+		return tx.Handle(incmds.RanksTop, nop)
+	})
+	if err != nil || r.lookup(incmds.StatsTop) != nil || r.lookup(incmds.StatsUser) == nil || r.lookup(incmds.RanksTop) == nil {
+		t.Fatalf("update was not applied: %v", err)
+	}
+}
+
+func TestReplaceSwapsLobbies(t *testing.T) {
+	served := make(chan string, 1)
+	lobby := func(name string) *Router {
+		l := NewRouter()
+		l.HandleFunc(incmds.Ready, func(ctx context.Context, c *UserConn, m *RawMessage) { served <- name })
+		return l
+	}
+	nop := HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {})
+	r := NewRouter()
+	r.Handle(incmds.StatsTop, nop)
+	r.Handle(incmds.Sync, nop)
+	r.Handle(incmds.LobbyCmds, lobby("first"))
+
+	err := r.Replace(LobbyRange.Lo, LobbyRange.Hi, func(tx *Router) error {
+		return tx.Handle(incmds.LobbyCmds, lobby("second"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.ServeWS(t.Context(), &UserConn{user: &User{}}, &RawMessage{Cmd: incmds.Ready})
+	if name := <-served; name != "second" {
+		t.Fatalf("served by %s lobby", name)
+	}
+	if r.load().routes[incmds.Sync] != nil || r.lookup(incmds.StatsTop) == nil {
+		t.Fatal("Replace did not clear exactly its range")
+	}
+
+	if err := r.Replace(LobbyRange.Lo, LobbyRange.Hi, func(tx *Router) error {
+		return errors.New("lobby is gone")
+	}); err == nil || len(r.Mounts()) != 1 {
+		t.Fatalf("failed replace changed the routes: %v", err)
+	}
+}
+
+func TestRoutingWhileRegistering(t *testing.T) {
+	nop := HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {})
+	r := NewRouter()
+	r.Handle(incmds.StatsTop, nop)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			r.Handle(incmds.RanksTop, nop)
+			r.RemoveCommand(incmds.RanksTop)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if r.lookup(incmds.StatsTop) == nil {
+			t.Fatal("route went missing while another was registered")
+		}
+	}
+	wg.Wait()
+}
+
+func TestMiddlewareIsChainedOncePerTable(t *testing.T) {
+	c := &UserConn{user: &User{Name: "Somebody"}}
+	built, served := 0, 0
+	r := NewRouter()
+	r.HandleFunc(incmds.StatsTop, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		served++
+	})
+	r.Use(func(h Handler) Handler {
+		built++
+		return h
+	})
+	for i := 0; i < 3; i++ {
+		r.ServeWS(t.Context(), c, &RawMessage{Cmd: incmds.StatsTop})
+	}
+	if served != 3 || built != 1 {
+		t.Fatalf("served %d messages through %d chains, want 3 through 1", served, built)
+	}
+}
@@ -0,0 +1,116 @@
+package qws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/amh11706/qws/incmds"
+	"github.com/amh11706/qws/outcmds"
+)
+
+// ErrRequestClosed is returned by Request when the connection closes before
+// the client replies.
+var ErrRequestClosed = errors.New("connection closed before the client replied")
+
+// requests tracks the server's requests that are waiting for a reply. Ids are
+// the server's own: a client reply is told apart from a client request by
+// its incmds.Reply command, not by its Id.
+type requests struct {
+	lock    sync.Mutex
+	nextId  uint32
+	pending map[uint32]chan json.RawMessage
+	closed  bool
+}
+
+func (r *requests) add() (uint32, chan json.RawMessage, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return 0, nil, ErrRequestClosed
+	}
+	if r.pending == nil {
+		r.pending = make(map[uint32]chan json.RawMessage)
+	}
+	r.nextId++
+	if r.nextId == 0 {
+		r.nextId++
+	}
+	ch := make(chan json.RawMessage, 1)
+	r.pending[r.nextId] = ch
+	return r.nextId, ch, nil
+}
+
+func (r *requests) remove(id uint32) {
+	r.lock.Lock()
+	delete(r.pending, id)
+	r.lock.Unlock()
+}
+
+// resolve hands a reply to the request waiting for it. Replies to requests
+// that already gave up are dropped.
+func (r *requests) resolve(id uint32, data json.RawMessage) {
+	r.lock.Lock()
+	ch := r.pending[id]
+	delete(r.pending, id)
+	r.lock.Unlock()
+	if ch != nil {
+		ch <- data
+	}
+}
+
+func (r *requests) close() {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = nil
+	r.closed = true
+	r.lock.Unlock()
+	for _, ch := range pending {
+		close(ch)
+	}
+}
+
+// Request sends data to the client under cmd with a fresh Id and waits for
+// the client to answer it with an incmds.Reply carrying the same Id.
+func (c *UserConn) Request(ctx context.Context, cmd outcmds.Cmd, data interface{}) (json.RawMessage, error) {
+	id, ch, err := c.requests.add()
+	if err != nil {
+		return nil, err
+	}
+	c.SendRaw(ctx, &Message{Cmd: cmd, Id: id, Data: data})
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, ErrRequestClosed
+		}
+		return reply, nil
+	case <-ctx.Done():
+		c.requests.remove(id)
+		return nil, ctx.Err()
+	}
+}
+
+// RequestInto is Request with the reply decoded into T.
+func RequestInto[T any](ctx context.Context, c *UserConn, cmd outcmds.Cmd, data interface{}) (T, error) {
+	var out T
+	reply, err := c.Request(ctx, cmd, data)
+	if err != nil {
+		return out, err
+	}
+	if len(reply) > 0 {
+		err = json.Unmarshal(reply, &out)
+	}
+	return out, err
+}
+
+// handleReply resolves m if it is a reply to a server request. Replies skip
+// the ordered queue, since the handler waiting on one may be what the queue
+// is waiting on.
+func (c *UserConn) handleReply(m *RawMessage) bool {
+	if m.Cmd != incmds.Reply {
+		return false
+	}
+	c.requests.resolve(m.Id, m.Data)
+	return true
+}
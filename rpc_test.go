@@ -0,0 +1,71 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+)
+
+func TestRequestResolvesOnReply(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	b.Handle(outcmds.Turn, func(ctx context.Context, b *BotConn, m *ClientMessage) {
+		b.Reply(ctx, m.Id, map[string]int{"move": 3})
+	})
+	b.Start(t.Context())
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	reply, err := RequestInto[struct{ Move int }](ctx, b.UserConn, outcmds.Turn, nil)
+	if err != nil || reply.Move != 3 {
+		t.Fatalf("Request = %+v, %v", reply, err)
+	}
+}
+
+func TestRequestEndsWithContextAndClose(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	b.Start(t.Context())
+
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.Request(ctx, outcmds.Turn, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unanswered request returned %v", err)
+	}
+	b.requests.lock.Lock()
+	pending := len(b.requests.pending)
+	b.requests.lock.Unlock()
+	if pending != 0 {
+		t.Fatal("timed out request was not forgotten")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Request(t.Context(), outcmds.Turn, nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	b.Close()
+	select {
+	case err := <-done:
+		if err != ErrRequestClosed {
+			t.Fatalf("request on a closed connection returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not end the pending request")
+	}
+}
+
+func TestCancelSuppressesRepliesButNotRequests(t *testing.T) {
+	req := &runningRequest{id: 1}
+	req.cancelled.Store(true)
+	ctx := context.WithValue(t.Context(), runningRequestKey{}, req)
+	if !suppressed(ctx, &Message{Id: 1}) {
+		t.Fatal("reply to a cancelled request was sent")
+	}
+	if suppressed(ctx, &Message{Cmd: outcmds.Turn, Id: 1}) {
+		t.Fatal("a request the handler made with the same Id was suppressed")
+	}
+}
@@ -0,0 +1,193 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amh11706/logger"
+	"github.com/amh11706/qws/outcmds"
+	"github.com/gorilla/websocket"
+)
+
+// Server accepts websocket connections and keeps track of the live ones. It
+// owns the handshake: the login frame, authentication, the client version
+// check, and numbering the connection.
+type Server struct {
+	Auth     Authenticator
+	Upgrader websocket.Upgrader
+	// CheckVersion refuses clients it returns an error for. Nil accepts any.
+	CheckVersion func(version string) error
+	// Sessions, when set, makes accepted connections resumable.
+	Sessions *SessionStore
+	// IPHeader names a header a trusted proxy puts the client address in.
+	// When empty the address is taken from the request.
+	IPHeader string
+	// HandshakeTimeout bounds the wait for the login frame.
+	HandshakeTimeout time.Duration
+
+	lock     sync.Mutex
+	conns    map[int64]*UserConn
+	accounts map[string]*account
+}
+
+// account is every live connection of one user. Connections of a registered
+// user share one *User, guests only share the copy numbering.
+type account struct {
+	user   *User
+	copies map[int64]*UserConn
+}
+
+// nextSId is shared by every Server so session ids never collide.
+var nextSId atomic.Int64
+
+func NewServer(auth Authenticator) *Server {
+	return &Server{
+		Auth:     auth,
+		conns:    make(map[int64]*UserConn),
+		accounts: make(map[string]*account),
+	}
+}
+
+// Accept upgrades the request and runs the handshake. The returned UserConn
+// is already writing, so the caller only has to set up its routes and then
+// run ListenRead followed by Disconnect. When resumed is set, the client
+// resumed a session and c is the conn it had, which already has its routes
+// and close hooks, so the caller only runs ListenRead and Disconnect. A
+// refused handshake closes the socket with a *CloseReason, which is also
+// returned.
+func (s *Server) Accept(w http.ResponseWriter, r *http.Request) (c *UserConn, resumed bool, err error) {
+	up := s.Upgrader
+	if up.Subprotocols == nil {
+		up.Subprotocols = Subprotocols
+	}
+	ws, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an HTTP error.
+		return nil, false, err
+	}
+
+	c, resumed, err = s.handshake(r.Context(), ws, clientIP(r, s.IPHeader))
+	if err != nil {
+		var reason *CloseReason
+		if !errors.As(err, &reason) {
+			logger.CheckP(err, "Handshake:")
+			reason = ErrLoginFailed
+		}
+		msg := websocket.FormatCloseMessage(reason.Code, reason.Reason)
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ws.Close()
+		return nil, false, reason
+	}
+	return c, resumed, nil
+}
+
+func (s *Server) handshake(ctx context.Context, ws *websocket.Conn, ip string) (*UserConn, bool, error) {
+	timeout := s.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = connectionTimeout
+	}
+	ws.SetReadLimit(MaxHandshakeSize)
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	_, b, err := ws.ReadMessage()
+	if err != nil {
+		return nil, false, err
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	login := &LoginFrame{}
+	if err := CodecFor(ws.Subprotocol()).Unmarshal(b, login); err != nil {
+		return nil, false, ErrBadLoginFrame
+	}
+	if s.CheckVersion != nil && s.CheckVersion(login.Version) != nil {
+		return nil, false, ErrClientVersion
+	}
+
+	if login.Resume != "" && s.Sessions != nil {
+		c, err := s.Sessions.Resume(ctx, login.Resume, NewWebsocketTransport(ws), login.Seq)
+		if err != nil {
+			// Some frames may already have been replayed, so the socket
+			// cannot carry on as a fresh login. The client logs in again on
+			// a new one.
+			logger.CheckP(err, "Resume:")
+			return nil, false, ErrResumeFailed
+		}
+		c.SetChunked(login.Chunks)
+		c.ListenWrite(ctx)
+		return c, true, nil
+	}
+
+	u, err := s.Auth.Authenticate(ctx, login)
+	if err != nil {
+		return nil, false, err
+	}
+	c := s.register(ctx, u, ws, ip)
+	c.SetChunked(login.Chunks)
+	if !u.IsGuest() {
+		u.AddIp(ctx, ip)
+	}
+	if s.Sessions != nil {
+		s.Sessions.Start(ctx, c)
+	}
+	SendTyped(ctx, c, outcmds.SessionIdCmd, c.SId)
+	SendTyped(ctx, c, outcmds.CopyCmd, c.Copy)
+	c.ListenWrite(ctx)
+	return c, false, nil
+}
+
+func accountKey(u *User) string {
+	if u.IsGuest() {
+		return "guest"
+	}
+	return strconv.FormatInt(int64(u.Id), 10)
+}
+
+func (s *Server) register(ctx context.Context, u *User, ws *websocket.Conn, ip string) *UserConn {
+	s.lock.Lock()
+	key := accountKey(u)
+	a := s.accounts[key]
+	if a == nil {
+		a = &account{user: u, copies: make(map[int64]*UserConn)}
+		s.accounts[key] = a
+	}
+	if !u.IsGuest() {
+		u = a.user
+	}
+	copy := int64(1)
+	for a.copies[copy] != nil {
+		copy++
+	}
+	c := NewUserConn(u, ws, ip)
+	c.SId = nextSId.Add(1)
+	c.Copy = copy
+	a.copies[copy] = c
+	s.conns[c.SId] = c
+	s.lock.Unlock()
+
+	logger.Check(c.AddCloseHook(ctx, NewCloseHandler(s.unregister)))
+	return c
+}
+
+func (s *Server) unregister(ctx context.Context, c *UserConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, c.SId)
+	key := accountKey(c.User())
+	if a := s.accounts[key]; a != nil && a.copies[c.Copy] == c {
+		delete(a.copies, c.Copy)
+		if len(a.copies) == 0 {
+			delete(s.accounts, key)
+		}
+	}
+}
+
+// Conn returns the live connection with the given session id, or nil.
+func (s *Server) Conn(sid int64) *UserConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conns[sid]
+}
@@ -0,0 +1,144 @@
+package qws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+	"github.com/gorilla/websocket"
+)
+
+type accepted struct {
+	c       *UserConn
+	resumed bool
+}
+
+func newTestServer(t *testing.T, s *Server) (string, chan accepted) {
+	t.Helper()
+	conns := make(chan accepted, 4)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, resumed, err := s.Accept(w, r)
+		if err != nil {
+			return
+		}
+		conns <- accepted{c, resumed}
+		c.ListenRead(r.Context())
+		c.Disconnect()
+	}))
+	t.Cleanup(hs.Close)
+	return "ws" + strings.TrimPrefix(hs.URL, "http"), conns
+}
+
+func dialLogin(t *testing.T, url string, login string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(login)); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestAcceptNumbersGuestCopies(t *testing.T) {
+	auth := NewMemoryAuthenticator()
+	auth.AllowGuests = true
+	url, conns := newTestServer(t, NewServer(auth))
+
+	dialLogin(t, url, `{"version":"1"}`)
+	dialLogin(t, url, `{"version":"1"}`)
+	var copies []int64
+	for i := 0; i < 2; i++ {
+		select {
+		case a := <-conns:
+			c := a.c
+			if !c.IsGuest() || c.SId == 0 || a.resumed {
+				t.Fatalf("accepted %s with sid %d", c.PrintName(), c.SId)
+			}
+			copies = append(copies, c.Copy)
+		case <-time.After(time.Second):
+			t.Fatal("guest was not accepted")
+		}
+	}
+	if copies[0] == copies[1] {
+		t.Fatalf("two guests were both given copy %d", copies[0])
+	}
+}
+
+func TestAcceptRefusesWithCloseReason(t *testing.T) {
+	s := NewServer(NewMemoryAuthenticator())
+	s.CheckVersion = func(v string) error {
+		if v != "2" {
+			return ErrClientVersion
+		}
+		return nil
+	}
+	s.Sessions = NewSessionStore(time.Minute)
+	url, _ := newTestServer(t, s)
+
+	for login, want := range map[string]*CloseReason{
+		`{"token":"nope","version":"2"}`:  ErrBadToken,
+		`{"token":"nope","version":"1"}`:  ErrClientVersion,
+		`not json`:                        ErrBadLoginFrame,
+		`{"resume":"gone","version":"2"}`: ErrResumeFailed,
+	} {
+		ws := dialLogin(t, url, login)
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := ws.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != want.Code {
+			t.Fatalf("login %s: got %v, want close code %d", login, err, want.Code)
+		}
+	}
+}
+
+func TestAcceptReportsResumedSessions(t *testing.T) {
+	auth := NewMemoryAuthenticator()
+	auth.AllowGuests = true
+	s := NewServer(auth)
+	s.Sessions = NewSessionStore(time.Minute)
+	url, conns := newTestServer(t, s)
+
+	ws := dialLogin(t, url, `{"version":"1"}`)
+	first := <-conns
+	if first.resumed {
+		t.Fatal("a fresh login was reported as resumed")
+	}
+	token := ""
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for token == "" {
+		_, b, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := DecodeClientMessage(JSONCodec, b, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Cmd == outcmds.SessionResume {
+			var info SessionInfo
+			if err := json.Unmarshal(m.Data, &info); err != nil {
+				t.Fatal(err)
+			}
+			token = info.Token
+		}
+	}
+	ws.Close()
+	waitDetached(t, first.c)
+
+	dialLogin(t, url, `{"version":"1","resume":"`+token+`"}`)
+	select {
+	case a := <-conns:
+		if !a.resumed || a.c != first.c {
+			t.Fatalf("resume accepted %p, resumed %v; want %p, true", a.c, a.resumed, first.c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resume was not accepted")
+	}
+}
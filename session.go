@@ -0,0 +1,235 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A session lets a client whose socket dropped come back within a grace
+// window and carry on with the same UserConn, keeping its routes and close
+// hooks. Every message frame written to the client is numbered from 1, and the
+// client counts the frames it has received. On resume it reports that count
+// and the frames it missed are written again before anything new.
+
+// DefaultResumeGrace is how long a dropped session waits for its client.
+const DefaultResumeGrace = 10 * time.Second
+
+// replayFrames is how many written frames a session keeps for replay. A
+// client that missed more than this has to start over.
+const replayFrames = 256
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionCodec    = errors.New("session resumed with a different codec")
+	ErrReplayGap       = errors.New("session can no longer replay what the client missed")
+)
+
+// SessionInfo is sent to the client under outcmds.SessionResume when its
+// session starts.
+type SessionInfo struct {
+	Token string `json:"token"`
+	// Grace is the resume window in seconds.
+	Grace int64 `json:"grace"`
+}
+
+type SessionStore struct {
+	Grace    time.Duration
+	lock     sync.Mutex
+	sessions map[string]*UserConn
+}
+
+func NewSessionStore(grace time.Duration) *SessionStore {
+	return &SessionStore{Grace: grace, sessions: make(map[string]*UserConn)}
+}
+
+func (s *SessionStore) grace() time.Duration {
+	if s.Grace <= 0 {
+		return DefaultResumeGrace
+	}
+	return s.Grace
+}
+
+type session struct {
+	token    string
+	store    *SessionStore
+	history  replayRing
+	expiry   *time.Timer
+	detached bool
+	// lost is set once the session can no longer be resumed, e.g. because
+	// frames were dropped while it was detached.
+	lost bool
+}
+
+// Start makes c resumable and tells the client its resume token. Call it
+// before ListenWrite so the token is the first numbered frame.
+func (s *SessionStore) Start(ctx context.Context, c *UserConn) {
+	sess := &session{token: uuid.NewString(), store: s}
+	c.sockLock.Lock()
+	c.session = sess
+	c.sockLock.Unlock()
+
+	s.lock.Lock()
+	s.sessions[sess.token] = c
+	s.lock.Unlock()
+	SendTyped(ctx, c, SessionResumeCmd, &SessionInfo{Token: sess.token, Grace: int64(s.grace() / time.Second)})
+}
+
+// Resume attaches ws to the session with the given token and writes every
+// frame after lastSeq to it. The caller then runs ListenWrite and ListenRead
+// on the returned UserConn, which keeps the routes and close hooks it had
+// before. If the missed frames are
+// no longer available the old session is closed and ErrReplayGap returned, and
+// the client has to log in again.
+func (s *SessionStore) Resume(ctx context.Context, token string, ws Transport, lastSeq uint32) (*UserConn, error) {
+	s.lock.Lock()
+	c := s.sessions[token]
+	s.lock.Unlock()
+	if c == nil {
+		return nil, ErrSessionNotFound
+	}
+	if CodecFor(ws.Subprotocol()) != c.Codec() {
+		return nil, ErrSessionCodec
+	}
+
+	c.sockLock.Lock()
+	sess := c.session
+	if c.closed.Load() || sess == nil || sess.lost {
+		c.sockLock.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	if sess.expiry != nil {
+		if !sess.expiry.Stop() {
+			// The grace window ran out and the session is being closed.
+			c.sockLock.Unlock()
+			return nil, ErrSessionNotFound
+		}
+		sess.expiry = nil
+	}
+	old := c.conn
+	c.socketGen++
+	c.sockLock.Unlock()
+
+	// The old socket may not have noticed it is dead yet. Closing it ends its
+	// ListenRead, and its writer has to be gone before the replay so that it
+	// cannot take another frame off the queue behind it.
+	old.Close()
+	if err := c.stopWriter(ctx); err != nil {
+		s.expire(c)
+		return nil, err
+	}
+
+	// Holding writeLock from the swap to the end of the replay keeps
+	// SendMessageSync from writing to ws ahead of the frames it missed.
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.sockLock.Lock()
+	c.conn = ws
+	sess.detached = false
+	frames, ok := sess.history.since(lastSeq)
+	if !ok {
+		sess.lost = true
+	}
+	c.sockLock.Unlock()
+	if !ok {
+		s.expire(c)
+		return nil, ErrReplayGap
+	}
+
+	ws.SetReadLimit(MaxMessageSize)
+	for _, m := range frames {
+		if err := ws.WritePrepared(m); err != nil {
+			// The frames stay in the history, so the client can try again
+			// within a fresh grace window.
+			c.sockLock.Lock()
+			if !c.closed.Load() {
+				c.park(sess)
+			}
+			c.sockLock.Unlock()
+			return nil, err
+		}
+	}
+	c.lastMessageReceived.Store(time.Now().UnixNano())
+	return c, nil
+}
+
+// expire ends a session for good, running its close hooks.
+func (s *SessionStore) expire(c *UserConn) {
+	c.Close()
+}
+
+func (s *SessionStore) remove(token string) {
+	s.lock.Lock()
+	delete(s.sessions, token)
+	s.lock.Unlock()
+}
+
+// Disconnect is called once ListenRead returns. Without a session it is the
+// same as Close. With one the connection is parked for the grace window and
+// only closed if its client does not resume it in time.
+func (c *UserConn) Disconnect() {
+	c.sockLock.Lock()
+	sess := c.session
+	if sess == nil || sess.lost || c.closed.Load() {
+		c.sockLock.Unlock()
+		c.Close()
+		return
+	}
+	if c.readerGen != c.socketGen {
+		// The socket this reader was on has already been replaced by a resume.
+		c.sockLock.Unlock()
+		return
+	}
+	c.park(sess)
+	c.sockLock.Unlock()
+}
+
+// park closes the socket and leaves the session waiting for its client to
+// resume it until the grace window runs out. sockLock must be held.
+func (c *UserConn) park(sess *session) {
+	sess.detached = true
+	c.conn.Close()
+	sess.expiry = time.AfterFunc(sess.store.grace(), func() { sess.store.expire(c) })
+}
+
+// endSession removes a closing connection's session from its store.
+func (c *UserConn) endSession() {
+	c.sockLock.Lock()
+	sess := c.session
+	if sess != nil && sess.expiry != nil {
+		sess.expiry.Stop()
+		sess.expiry = nil
+	}
+	c.sockLock.Unlock()
+	if sess != nil {
+		sess.store.remove(sess.token)
+	}
+}
+
+// replayRing keeps the most recently written frames. seq is the number of
+// the last frame added, so the first frame is 1.
+type replayRing struct {
+	frames [replayFrames]*PreparedMessage
+	seq    uint32
+}
+
+func (r *replayRing) add(m *PreparedMessage) {
+	r.seq++
+	r.frames[r.seq%replayFrames] = m
+}
+
+// since returns every frame after last, or false if some of them have
+// already been overwritten.
+func (r *replayRing) since(last uint32) ([]*PreparedMessage, bool) {
+	if last > r.seq || r.seq-last > replayFrames {
+		return nil, false
+	}
+	frames := make([]*PreparedMessage, 0, r.seq-last)
+	for seq := last + 1; seq <= r.seq; seq++ {
+		frames = append(frames, r.frames[seq%replayFrames])
+	}
+	return frames, true
+}
@@ -0,0 +1,197 @@
+package qws
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+	"github.com/gorilla/websocket"
+)
+
+func TestReplayRingReturnsFramesAfterLastSeen(t *testing.T) {
+	r := &replayRing{}
+	sent := make([]*PreparedMessage, 10)
+	for i := range sent {
+		sent[i] = NewPreparedMessage(websocket.TextMessage, []byte{byte(i)})
+		r.add(sent[i])
+	}
+
+	frames, ok := r.since(7)
+	if !ok || len(frames) != 3 {
+		t.Fatalf("since(7) = %d frames, %v; want 3", len(frames), ok)
+	}
+	for i, m := range frames {
+		if m != sent[7+i] {
+			t.Fatalf("frame %d is out of order", i)
+		}
+	}
+	if frames, ok := r.since(10); !ok || len(frames) != 0 {
+		t.Fatalf("a client that saw everything got %d frames, %v", len(frames), ok)
+	}
+	if _, ok := r.since(11); ok {
+		t.Fatal("a client claiming frames that were never sent was accepted")
+	}
+}
+
+func TestReplayRingRefusesOverwrittenFrames(t *testing.T) {
+	r := &replayRing{}
+	m := NewPreparedMessage(websocket.TextMessage, []byte("x"))
+	for i := 0; i < replayFrames+5; i++ {
+		r.add(m)
+	}
+	if _, ok := r.since(4); ok {
+		t.Fatal("replayed past frames the ring no longer holds")
+	}
+	if frames, ok := r.since(5); !ok || len(frames) != replayFrames {
+		t.Fatalf("since(5) = %d frames, %v; want %d", len(frames), ok, replayFrames)
+	}
+}
+
+func TestSendSyncIsNumberedForReplay(t *testing.T) {
+	server, client := Pipe(JSONCodec)
+	defer client.Close()
+	c := NewTransportUserConn(NewGuest(), server, "127.0.0.1")
+	NewSessionStore(time.Minute).Start(t.Context(), c)
+	c.SendSync(t.Context(), outcmds.Sync, 1)
+
+	c.sockLock.Lock()
+	seq := c.session.history.seq
+	c.sockLock.Unlock()
+	if seq != 1 {
+		t.Fatalf("history has %d frames after SendSync, want 1", seq)
+	}
+	if _, b, err := client.ReadMessage(); err != nil || !bytes.Contains(b, []byte(`"cmd":`+strconv.Itoa(int(outcmds.Sync)))) {
+		t.Fatalf("client read %s, %v", b, err)
+	}
+}
+
+// startSession runs c on server as Server.Accept would and returns the
+// token the client was sent.
+func startSession(t *testing.T, store *SessionStore, c *UserConn, client *PipeEnd) string {
+	t.Helper()
+	store.Start(t.Context(), c)
+	runConn(t, c)
+	var info SessionInfo
+	readCmd(t, client, outcmds.SessionResume, &info)
+	return info.Token
+}
+
+func runConn(t *testing.T, c *UserConn) {
+	c.ListenWrite(t.Context())
+	go func() {
+		c.ListenRead(t.Context())
+		c.Disconnect()
+	}()
+}
+
+// readCmd reads from client until a frame with cmd arrives.
+func readCmd(t *testing.T, client *PipeEnd, cmd outcmds.Cmd, v interface{}) {
+	t.Helper()
+	deadline := time.AfterFunc(time.Second, func() { client.Close() })
+	defer deadline.Stop()
+	for {
+		_, b, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("no frame with cmd %d: %v", cmd, err)
+		}
+		m, err := DecodeClientMessage(JSONCodec, b, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Cmd == cmd {
+			if err := json.Unmarshal(m.Data, v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+func waitDetached(t *testing.T, c *UserConn) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		c.sockLock.Lock()
+		detached := c.session.detached && c.session.expiry != nil
+		c.sockLock.Unlock()
+		if detached {
+			return
+		}
+	}
+	t.Fatal("session was not parked")
+}
+
+func TestDisconnectThenResumeReplaysMissedFrames(t *testing.T) {
+	store := NewSessionStore(time.Minute)
+	server, client := Pipe(JSONCodec)
+	c := NewTransportUserConn(NewGuest(), server, "127.0.0.1")
+	defer c.Close()
+	token := startSession(t, store, c, client)
+
+	client.Close()
+	waitDetached(t, c)
+	c.Send(t.Context(), outcmds.Sync, 7)
+
+	server, client = Pipe(JSONCodec)
+	defer client.Close()
+	resumed, err := store.Resume(t.Context(), token, server, 1)
+	if err != nil || resumed != c {
+		t.Fatalf("resume = %v, %v", resumed, err)
+	}
+	runConn(t, c)
+	var got int
+	readCmd(t, client, outcmds.Sync, &got)
+	if got != 7 {
+		t.Fatalf("missed frame carried %d, want 7", got)
+	}
+}
+
+func TestResumeParksSessionWhenReplayFails(t *testing.T) {
+	store := NewSessionStore(time.Minute)
+	server, client := Pipe(JSONCodec)
+	c := NewTransportUserConn(NewGuest(), server, "127.0.0.1")
+	defer c.Close()
+	token := startSession(t, store, c, client)
+	client.Close()
+	waitDetached(t, c)
+
+	dead, deadClient := Pipe(JSONCodec)
+	deadClient.Close()
+	if _, err := store.Resume(t.Context(), token, dead, 0); err == nil {
+		t.Fatal("replay to a closed socket succeeded")
+	}
+	waitDetached(t, c)
+
+	server, client = Pipe(JSONCodec)
+	defer client.Close()
+	if _, err := store.Resume(t.Context(), token, server, 0); err != nil {
+		t.Fatalf("retried resume failed: %v", err)
+	}
+	var info SessionInfo
+	readCmd(t, client, outcmds.SessionResume, &info)
+	if info.Token != token {
+		t.Fatalf("replayed token %q, want %q", info.Token, token)
+	}
+}
+
+func TestResumeRefusesExpiringSession(t *testing.T) {
+	store := NewSessionStore(time.Minute)
+	server, client := Pipe(JSONCodec)
+	c := NewTransportUserConn(NewGuest(), server, "127.0.0.1")
+	defer c.Close()
+	token := startSession(t, store, c, client)
+	client.Close()
+	waitDetached(t, c)
+
+	// Stop the timer as if it had just fired, leaving expire to close c.
+	c.sockLock.Lock()
+	c.session.expiry.Stop()
+	c.sockLock.Unlock()
+	server, client = Pipe(JSONCodec)
+	defer client.Close()
+	if _, err := store.Resume(t.Context(), token, server, 0); err != ErrSessionNotFound {
+		t.Fatalf("resume of an expiring session = %v, want ErrSessionNotFound", err)
+	}
+}
@@ -0,0 +1,61 @@
+package qws
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DefaultTimeout is how long a handler's context lasts when its route does
+// not set one with RouteTimeout.
+var DefaultTimeout = 2 * time.Second
+
+// RouteTimeout sets how long the route's handler has before its context is
+// cancelled. On a mount it is the default for every route under it.
+func RouteTimeout(d time.Duration) RouteOption {
+	return func(r *route) {
+		r.timeout = d
+	}
+}
+
+type budgetKey struct{}
+
+// budget is the timeout for a route without its own, set by the mounts
+// the message passed through.
+func budget(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(budgetKey{}).(time.Duration); ok {
+		return d
+	}
+	return DefaultTimeout
+}
+
+// withBudget runs h under the route's timeout. Routes that lead to another
+// Router only pass their timeout on, so the handler that ends up serving the
+// message gets one budget rather than the shortest of several. Handlers that
+// run past their budget are logged.
+func (rt *route) withBudget(r *Router, h Handler) Handler {
+	if _, nested := rt.handler.(*Router); nested {
+		if rt.timeout <= 0 {
+			return h
+		}
+		return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+			h.ServeWS(context.WithValue(ctx, budgetKey{}, rt.timeout), c, m)
+		})
+	}
+	return HandlerFunc(func(ctx context.Context, c *UserConn, m *RawMessage) {
+		d := rt.timeout
+		if d <= 0 {
+			d = budget(ctx)
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		start := time.Now()
+		h.ServeWS(ctx, c, m)
+		if took := time.Since(start); took > d {
+			log.Printf(
+				"\x1b[36m%s\x1b[0m (user %d) cmd %d on router %q took %v, over its %v budget\n",
+				c.PrintName(), c.UserId(), m.Cmd, r.Name, took.Round(time.Millisecond), d,
+			)
+		}
+	})
+}
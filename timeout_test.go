@@ -0,0 +1,77 @@
+package qws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+func TestRouteTimeout(t *testing.T) {
+	c := &UserConn{user: &User{Name: "Somebody"}}
+	budgets := make(map[incmds.Cmd]time.Duration)
+	record := func(ctx context.Context, c *UserConn, m *RawMessage) {
+		deadline, _ := ctx.Deadline()
+		budgets[m.Cmd] = time.Until(deadline).Round(time.Second)
+	}
+
+	lobby := NewRouter()
+	lobby.HandleFunc(incmds.LobbyCreate, record)
+	lobby.HandleFunc(incmds.MapSave, record, RouteTimeout(30*time.Second))
+	r := NewRouter()
+	r.HandleFunc(incmds.StatsTop, record)
+	r.HandleFunc(incmds.MatchData, record, RouteTimeout(10*time.Second))
+	r.Handle(incmds.LobbyCmds, lobby, RouteTimeout(5*time.Second))
+
+	for _, cmd := range []incmds.Cmd{incmds.StatsTop, incmds.MatchData, incmds.LobbyCreate, incmds.MapSave} {
+		r.ServeWS(t.Context(), c, &RawMessage{Cmd: cmd})
+	}
+	want := map[incmds.Cmd]time.Duration{
+		incmds.StatsTop:    DefaultTimeout,
+		incmds.MatchData:   10 * time.Second,
+		incmds.LobbyCreate: 5 * time.Second,
+		incmds.MapSave:     30 * time.Second,
+	}
+	for cmd, d := range want {
+		if budgets[cmd] != d {
+			t.Errorf("cmd %d had %v, want %v", cmd, budgets[cmd], d)
+		}
+	}
+}
+
+func TestOverrunIsLogged(t *testing.T) {
+	out := &bytes.Buffer{}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(out)
+
+	c := &UserConn{user: &User{Id: 9, Name: "Somebody"}}
+	r := NewRouter()
+	r.Name = "main"
+	r.HandleFunc(incmds.MapSave, func(ctx context.Context, c *UserConn, m *RawMessage) {
+		<-ctx.Done()
+		time.Sleep(5 * time.Millisecond)
+	}, RouteTimeout(time.Millisecond))
+	r.ServeWS(t.Context(), c, &RawMessage{Cmd: incmds.MapSave})
+
+	want := fmt.Sprintf(`(user 9) cmd %d on router "main"`, incmds.MapSave)
+	if line := out.String(); !strings.Contains(line, want) ||
+		!strings.Contains(line, "over its 1ms budget") {
+		t.Fatalf("logged %q", line)
+	}
+}
+
+func TestContextEndsOnClose(t *testing.T) {
+	c := NewBotConn(-1, &User{Name: "Bot"})
+	ctx := c.Context()
+	c.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Context outlived the connection")
+	}
+}
@@ -0,0 +1,216 @@
+package qws
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/amh11706/logger"
+	"github.com/gorilla/websocket"
+)
+
+// Transport is the socket under a Conn. It is a websocket in production, see
+// NewWebsocketTransport, or one end of an in-memory Pipe in tests and tools.
+type Transport interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	WritePrepared(m *PreparedMessage) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetPongHandler(h func(appData string) error)
+	SetReadLimit(limit int64)
+	Subprotocol() string
+	Close() error
+}
+
+// PreparedMessage is an encoded message that can be written to any number of
+// connections using the codec it was encoded with. Unlike the websocket
+// package's own, its payload can be read back, which the in-memory transport
+// and bots need.
+type PreparedMessage struct {
+	frameType int
+	data      []byte
+	// large holds messages over MaxJsonSize, which are offloaded or split
+	// into chunks rather than sent as they are.
+	large *largeMessage
+
+	once sync.Once
+	ws   *websocket.PreparedMessage
+	err  error
+}
+
+func NewPreparedMessage(frameType int, data []byte) *PreparedMessage {
+	return &PreparedMessage{frameType: frameType, data: data}
+}
+
+func (m *PreparedMessage) FrameType() int {
+	return m.frameType
+}
+
+// Data is the encoded message. It must not be modified. For a large message
+// it is the stub pointing at the offloaded copy.
+func (m *PreparedMessage) Data() []byte {
+	if m.large != nil {
+		_, stub, err := m.large.offloaded()
+		logger.Check(err)
+		return stub
+	}
+	return m.data
+}
+
+// websocketPrepared wraps a message the websocket package prepared. Only a
+// websocket can write it.
+func websocketPrepared(ws *websocket.PreparedMessage) *PreparedMessage {
+	m := &PreparedMessage{ws: ws}
+	m.once.Do(func() {})
+	return m
+}
+
+// opaque reports whether m came from websocketPrepared, so there is no
+// payload to write anywhere but a websocket.
+func (m *PreparedMessage) opaque() bool {
+	return m.data == nil && m.large == nil && m.ws != nil
+}
+
+// websocket prepares the message for gorilla once, on first use, so it keeps
+// its per compression setting cache across every recipient.
+func (m *PreparedMessage) websocket() (*websocket.PreparedMessage, error) {
+	m.once.Do(func() {
+		m.ws, m.err = websocket.NewPreparedMessage(m.frameType, m.Data())
+	})
+	return m.ws, m.err
+}
+
+type websocketTransport struct {
+	*websocket.Conn
+}
+
+func NewWebsocketTransport(ws *websocket.Conn) Transport {
+	return websocketTransport{ws}
+}
+
+func (t websocketTransport) WritePrepared(m *PreparedMessage) error {
+	pm, err := m.websocket()
+	if err != nil {
+		return err
+	}
+	return t.WritePreparedMessage(pm)
+}
+
+var errPipeClosed = &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "pipe closed"}
+
+type pipeMessage struct {
+	messageType int
+	data        []byte
+}
+
+// PipeEnd is one end of an in-memory transport made by Pipe.
+type PipeEnd struct {
+	subprotocol string
+	in          chan pipeMessage
+	peer        *PipeEnd
+	closed      chan struct{}
+	closeOnce   *sync.Once
+	lock        sync.Mutex
+	pong        func(string) error
+	readLimit   int64
+}
+
+// pipeBuffer is how many messages a pipe end holds before writes block, the
+// way a socket's buffers would.
+const pipeBuffer = 256
+
+// Pipe connects two transports in memory. Pings are answered immediately, and
+// closing either end closes both. Both ends report codec's subprotocol, so a
+// Conn built on one uses that codec.
+func Pipe(codec Codec) (*PipeEnd, *PipeEnd) {
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	a := &PipeEnd{subprotocol: codec.Name(), in: make(chan pipeMessage, pipeBuffer), closed: closed, closeOnce: once}
+	b := &PipeEnd{subprotocol: codec.Name(), in: make(chan pipeMessage, pipeBuffer), closed: closed, closeOnce: once}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (p *PipeEnd) ReadMessage() (int, []byte, error) {
+	// Anything already written is still delivered after a close.
+	select {
+	case m := <-p.in:
+		return p.checkLimit(m)
+	default:
+	}
+	select {
+	case m := <-p.in:
+		return p.checkLimit(m)
+	case <-p.closed:
+		return 0, nil, errPipeClosed
+	}
+}
+
+func (p *PipeEnd) checkLimit(m pipeMessage) (int, []byte, error) {
+	p.lock.Lock()
+	limit := p.readLimit
+	p.lock.Unlock()
+	if limit > 0 && int64(len(m.data)) > limit {
+		p.Close()
+		return 0, nil, websocket.ErrReadLimit
+	}
+	return m.messageType, m.data, nil
+}
+
+func (p *PipeEnd) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-p.closed:
+		return websocket.ErrCloseSent
+	default:
+	}
+	select {
+	case p.peer.in <- pipeMessage{messageType: messageType, data: data}:
+		return nil
+	case <-p.closed:
+		return websocket.ErrCloseSent
+	}
+}
+
+func (p *PipeEnd) WritePrepared(m *PreparedMessage) error {
+	if m.opaque() {
+		return nil
+	}
+	return p.WriteMessage(m.FrameType(), m.Data())
+}
+
+func (p *PipeEnd) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	switch messageType {
+	case websocket.PingMessage:
+		p.lock.Lock()
+		pong := p.pong
+		p.lock.Unlock()
+		if pong != nil {
+			return pong(string(data))
+		}
+		return nil
+	case websocket.CloseMessage:
+		return p.Close()
+	}
+	return errors.New("pipe: unsupported control message")
+}
+
+func (p *PipeEnd) SetPongHandler(h func(appData string) error) {
+	p.lock.Lock()
+	p.pong = h
+	p.lock.Unlock()
+}
+
+func (p *PipeEnd) SetReadLimit(limit int64) {
+	p.lock.Lock()
+	p.readLimit = limit
+	p.lock.Unlock()
+}
+
+func (p *PipeEnd) Subprotocol() string {
+	return p.subprotocol
+}
+
+func (p *PipeEnd) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
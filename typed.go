@@ -0,0 +1,40 @@
+package qws
+
+import (
+	"context"
+
+	"github.com/amh11706/qws/outcmds"
+)
+
+// Commands whose payloads are defined in qws. Most commands carry payloads
+// that belong to the app, such as Sync or LobbyUpdate; the app declares them
+// with outcmds.Typed next to their types. PlayerList is not declared here,
+// since its payload depends on the UserList it is broadcast from.
+var (
+	ChatMessageCmd   = outcmds.Typed[*Info](outcmds.ChatMessage)
+	SessionResumeCmd = outcmds.Typed[*SessionInfo](outcmds.SessionResume)
+	ChunkCmd         = outcmds.Typed[*Chunk](outcmds.Chunk)
+)
+
+// Sender is anything that can send a message to one client, such as a *Conn
+// or a UserConner.
+type Sender interface {
+	Send(ctx context.Context, cmd outcmds.Cmd, data interface{})
+}
+
+// SendTyped sends data under cmd. It is Send with the payload type checked at
+// compile time.
+func SendTyped[T any](ctx context.Context, c Sender, cmd outcmds.OutCmd[T], data T) {
+	c.Send(ctx, cmd.Cmd, data)
+}
+
+// BroadcastTyped sends data under cmd to every user in the list.
+func BroadcastTyped[U UserConner, T any](ctx context.Context, l UserList[U], cmd outcmds.OutCmd[T], data T) {
+	l.Broadcast(ctx, cmd.Cmd, data)
+}
+
+// BroadcastTypedFilter sends data under cmd to every user in the list for
+// which filter returns true.
+func BroadcastTypedFilter[U UserConner, T any](ctx context.Context, l UserList[U], cmd outcmds.OutCmd[T], data T, filter func(U) bool) {
+	l.BroadcastFilter(ctx, cmd.Cmd, data, filter)
+}
@@ -0,0 +1,43 @@
+package qws
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/outcmds"
+)
+
+func TestSendTypedAndBroadcastTyped(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	chat := b.Subscribe(outcmds.ChatMessage, 2)
+	b.Start(t.Context())
+	defer b.Close()
+
+	SendTyped(t.Context(), b, ChatMessageCmd, &Info{Message: "one"})
+	BroadcastTyped(t.Context(), UserList[*BotConn]{b.Id(): b}, ChatMessageCmd, &Info{Message: "two"})
+	for _, want := range []string{"one", "two"} {
+		select {
+		case m := <-chat:
+			var info Info
+			if err := json.Unmarshal(m.Data, &info); err != nil || info.Message != want {
+				t.Fatalf("bot got %s, %v; want %q", m.Data, err, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("bot did not receive %q", want)
+		}
+	}
+}
+
+func TestQwsPayloadsAreTyped(t *testing.T) {
+	for cmd, want := range map[outcmds.Cmd]interface{}{
+		outcmds.ChatMessage:   &Info{},
+		outcmds.SessionResume: &SessionInfo{},
+		outcmds.Chunk:         &Chunk{},
+	} {
+		if got, ok := outcmds.PayloadType(cmd); !ok || got != reflect.TypeOf(want) {
+			t.Fatalf("PayloadType(%d) = %v, %v", cmd, got, ok)
+		}
+	}
+}
@@ -28,6 +28,15 @@ type MessageSender interface {
 	RemoveCloseHook(context.Context, CloseHandler) error
 }
 
+// FrameSender is implemented by MessageSenders that queue frames the way a
+// UserConn does. Broadcasts encode a message once per codec and share the
+// frame between the recipients that implement it, and call Send for the
+// rest.
+type FrameSender interface {
+	SendFrame(ctx context.Context, f *Frame)
+	Codec() Codec
+}
+
 type UserConner interface {
 	SetInLobby(int64)
 	MessageSender
@@ -63,21 +72,22 @@ func (l UserList[T]) GroupByAdminLevel() map[AdminLevel]UserList[T] {
 
 func (l UserList[T]) BroadcastByAdminLevel(ctx context.Context) {
 	for al, ul := range l.GroupByAdminLevel() {
-		ul.Broadcast(ctx, outcmds.PlayerList, l.FilterForAdminLevel(al))
+		ul.BroadcastKeyed(ctx, outcmds.PlayerList, "", l.FilterForAdminLevel(al))
 	}
 }
 
 // Broadcast sends the provided message to every user in the list.
 func (l UserList[T]) Broadcast(ctx context.Context, cmd outcmds.Cmd, data interface{}) {
-	m, err := PrepareJsonMessage(cmd, data)
-	if logger.Check(err) {
-		return
-	}
-	for _, u := range l {
-		if !u.IsIgnored() {
-			u.SendMessage(ctx, m)
-		}
-	}
+	l.BroadcastFilter(ctx, cmd, data, func(T) bool { return true })
+}
+
+// BroadcastKeyed sends the provided message to every user in the list as a
+// keyed frame, replacing any frame for the same cmd and key still queued for
+// them. See NewKeyedFrame.
+func (l UserList[T]) BroadcastKeyed(ctx context.Context, cmd outcmds.Cmd, key string, data interface{}) {
+	set := newPreparedSet(cmd, data)
+	set.key, set.keyed = key, true
+	l.broadcast(ctx, set, func(T) bool { return true })
 }
 
 // BroadcastExcept sends the provided message to every user in the list except
@@ -90,14 +100,26 @@ func (l UserList[T]) BroadcastExcept(ctx context.Context, cmd outcmds.Cmd, data
 
 // BroadcastFilter sends the provided message to every user in the list for which
 // the provided filter func returns true.
+// The message is encoded once for each codec in use among the recipients.
 func (l UserList[T]) BroadcastFilter(ctx context.Context, cmd outcmds.Cmd, data interface{}, filter func(T) bool) {
-	m, err := PrepareJsonMessage(cmd, data)
-	if logger.Check(err) {
-		return
-	}
+	l.broadcast(ctx, newPreparedSet(cmd, data), filter)
+}
+
+func (l UserList[T]) broadcast(ctx context.Context, set *preparedSet, filter func(T) bool) {
+	defer set.done()
 	for _, u := range l {
-		if !u.IsIgnored() && filter(u) {
-			u.SendMessage(ctx, m)
+		if u.IsIgnored() || !filter(u) {
+			continue
+		}
+		fs, ok := any(u).(FrameSender)
+		if !ok {
+			u.Send(ctx, set.cmd, set.data)
+			continue
+		}
+		f, err := set.get(fs.Codec())
+		if logger.Check(err) {
+			return
 		}
+		fs.SendFrame(ctx, f)
 	}
 }
@@ -0,0 +1,367 @@
+package qws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Validator is implemented by input types that check themselves. Validate
+// runs after the validate tags pass, and an error it returns is sent to the
+// client as CodeBadRequest, or as is if it is an Error.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is one failed validate tag, listed in the Details of the
+// Error sent for an invalid input. Field is the path of the field as the
+// client sent it, like "moves[2].x".
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+}
+
+// Strict makes the route's dynamic handlers reject data with fields their
+// input type does not have. On a mount it applies to every route under it.
+func Strict() RouteOption {
+	return func(r *route) {
+		r.strict = true
+	}
+}
+
+type strictKey struct{}
+
+func withStrict(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strictKey{}, true)
+}
+
+func isStrict(ctx context.Context) bool {
+	strict, _ := ctx.Value(strictKey{}).(bool)
+	return strict
+}
+
+// unmarshalInput decodes data into in, rejecting unknown fields when strict.
+func unmarshalInput(data []byte, in interface{}, strict bool) error {
+	if !strict {
+		return json.Unmarshal(data, in)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(in); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
+// validateInput checks in against its validate tags and then its Validate
+// method, if it has one.
+func validateInput(in interface{}) error {
+	v := reflect.ValueOf(in)
+	var failed []FieldError
+	checkValue(v, "", &failed)
+	if len(failed) > 0 {
+		return NewError(CodeBadRequest, "Invalid request data.").WithDetails(failed)
+	}
+	if v.Elem().Kind() == reflect.Pointer && !v.Elem().IsNil() {
+		in = v.Elem().Interface()
+	}
+	if val, ok := in.(Validator); ok {
+		err := val.Validate()
+		if err == nil {
+			return nil
+		}
+		var e *Error
+		if errors.As(err, &e) {
+			return e
+		}
+		return NewError(CodeBadRequest, err.Error())
+	}
+	return nil
+}
+
+// A validate tag is a comma separated list of rules:
+//
+//	required     the field is not its zero value, or nil
+//	min=N, max=N the number is at least or most N, or the string, slice or
+//	             map has at least or most N elements
+//	len=N        the string, slice or map has exactly N elements
+//	oneof=a b c  the string or integer is one of the space separated values
+//	regex=expr   the string matches expr, which runs to the end of the tag
+//
+// Strings are measured in runes. Pointers are checked by what they point to
+// and skip every rule but required when nil.
+type rule struct {
+	name  string
+	num   float64
+	oneof []string
+	re    *regexp.Regexp
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	// embedded fields share their parent's path, like encoding/json.
+	embedded bool
+	rules    []rule
+}
+
+var typeRules sync.Map // reflect.Type -> []fieldRules
+
+// rulesFor parses the validate tags of struct type t. It panics on a
+// malformed tag, so a bad one is caught when its route is registered.
+func rulesFor(t reflect.Type) []fieldRules {
+	if cached, ok := typeRules.Load(t); ok {
+		return cached.([]fieldRules)
+	}
+	var list []fieldRules
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fr := fieldRules{index: i, name: name, embedded: f.Anonymous && f.Tag.Get("json") == ""}
+		if tag := f.Tag.Get("validate"); tag != "" {
+			rules, err := parseRules(tag, f.Type)
+			if err != nil {
+				panic(fmt.Sprintf("qws: validate tag on %s.%s: %v", t, f.Name, err))
+			}
+			fr.rules = rules
+		}
+		list = append(list, fr)
+	}
+	typeRules.Store(t, list)
+	return list
+}
+
+func parseRules(tag string, t reflect.Type) ([]rule, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var rules []rule
+	for tag != "" {
+		var part string
+		if strings.HasPrefix(tag, "regex=") {
+			part, tag = tag, ""
+		} else {
+			part, tag, _ = strings.Cut(tag, ",")
+		}
+		name, arg, _ := strings.Cut(part, "=")
+		r := rule{name: name}
+		switch name {
+		case "required":
+		case "min", "max", "len":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s needs a number: %w", name, err)
+			}
+			if !measurable(t, name != "len") {
+				return nil, fmt.Errorf("%s does not apply to %s", name, t)
+			}
+			r.num = n
+		case "oneof":
+			r.oneof = strings.Fields(arg)
+			if len(r.oneof) == 0 {
+				return nil, errors.New("oneof needs values")
+			}
+			switch t.Kind() {
+			case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			default:
+				return nil, fmt.Errorf("oneof does not apply to %s", t)
+			}
+		case "regex":
+			if t.Kind() != reflect.String {
+				return nil, fmt.Errorf("regex does not apply to %s", t)
+			}
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			r.re = re
+		default:
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// measurable reports whether min, max or len can apply to t. Numbers only
+// have a size for min and max.
+func measurable(t reflect.Type, numbers bool) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return numbers
+	}
+	return false
+}
+
+// checkValue appends the rules v and everything inside it fail.
+func checkValue(v reflect.Value, path string, failed *[]FieldError) {
+	if !v.IsValid() || !hasRules(v.Type()) {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			checkValue(v.Elem(), path, failed)
+		}
+	case reflect.Struct:
+		for _, fr := range rulesFor(v.Type()) {
+			fv := v.Field(fr.index)
+			fpath := fr.name
+			if fr.embedded {
+				fpath = path
+			} else if path != "" {
+				fpath = path + "." + fr.name
+			}
+			for _, r := range fr.rules {
+				if !r.check(fv) {
+					*failed = append(*failed, FieldError{Field: fpath, Rule: r.name})
+				}
+			}
+			checkValue(fv, fpath, failed)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			checkValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), failed)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			checkValue(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key()), failed)
+		}
+	}
+}
+
+var typeHasRules sync.Map // reflect.Type -> bool
+
+// hasRules reports whether values of t can reach a validate rule. Values
+// that cannot are not walked, so large untagged inputs cost nothing.
+func hasRules(t reflect.Type) bool {
+	if cached, ok := typeHasRules.Load(t); ok {
+		return cached.(bool)
+	}
+	has := findRules(t, make(map[reflect.Type]bool))
+	typeHasRules.Store(t, has)
+	return has
+}
+
+func findRules(t reflect.Type, seen map[reflect.Type]bool) bool {
+	switch t.Kind() {
+	case reflect.Interface:
+		// It can hold anything.
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return findRules(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return false
+		}
+		seen[t] = true
+		for _, fr := range rulesFor(t) {
+			if len(fr.rules) > 0 || findRules(t.Field(fr.index).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r rule) check(v reflect.Value) bool {
+	if r.name == "required" {
+		return !v.IsZero()
+	}
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+	}
+	switch r.name {
+	case "min":
+		return size(v) >= r.num
+	case "max":
+		return size(v) <= r.num
+	case "len":
+		return size(v) == r.num
+	case "oneof":
+		s := format(v)
+		for _, want := range r.oneof {
+			if s == want {
+				return true
+			}
+		}
+		return false
+	case "regex":
+		return r.re.MatchString(v.String())
+	}
+	return true
+}
+
+// format writes a string or integer the way it is written in a oneof rule.
+func format(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return v.String()
+}
+
+func size(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String()))
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// checkRules parses the validate tags of every struct reachable from t,
+// panicking on a malformed one.
+func checkRules(t reflect.Type) {
+	seen := make(map[reflect.Type]bool)
+	var walk func(reflect.Type)
+	walk = func(t reflect.Type) {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || seen[t] {
+			return
+		}
+		seen[t] = true
+		for _, fr := range rulesFor(t) {
+			walk(t.Field(fr.index).Type)
+		}
+	}
+	walk(t)
+}
@@ -0,0 +1,127 @@
+package qws
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amh11706/qws/incmds"
+)
+
+type validStep struct {
+	X int `json:"x" validate:"min=0,max=9"`
+}
+
+type validInput struct {
+	Name  string      `json:"name" validate:"required,max=5"`
+	Code  string      `json:"code,omitempty" validate:"len=3"`
+	Team  int         `json:"team" validate:"oneof=1 2"`
+	Slug  *string     `json:"slug" validate:"regex=^[a-z]{1,3}$"`
+	Steps []validStep `json:"steps"`
+}
+
+func (in validInput) Validate() error {
+	if in.Name == "admin" {
+		return errors.New("That name is reserved.")
+	}
+	return nil
+}
+
+func TestValidateInput(t *testing.T) {
+	slug := "abcd"
+	err := validateInput(&validInput{Code: "ab", Team: 3, Slug: &slug, Steps: []validStep{{X: 1}, {X: 10}}})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeBadRequest {
+		t.Fatalf("got %v", err)
+	}
+	want := []FieldError{
+		{Field: "name", Rule: "required"},
+		{Field: "code", Rule: "len"},
+		{Field: "team", Rule: "oneof"},
+		{Field: "slug", Rule: "regex"},
+		{Field: "steps[1].x", Rule: "max"},
+	}
+	if !reflect.DeepEqual(e.Details, want) {
+		t.Fatalf("failed %+v, want %+v", e.Details, want)
+	}
+
+	if err := validateInput(&validInput{Name: "né", Code: "abc", Team: 2}); err != nil {
+		t.Fatalf("valid input rejected: %v", err)
+	}
+	if err := validateInput(&validInput{Name: "admin", Code: "abc", Team: 1}); !errors.As(err, &e) || e.Message != "That name is reserved." {
+		t.Fatalf("Validate was not used: %v", err)
+	}
+}
+
+type validTile struct {
+	X, Y int
+	Kind string `json:"kind"`
+}
+
+type validTree struct {
+	Children []*validTree `json:"children"`
+	Step     validStep    `json:"step"`
+}
+
+func TestHasRulesSkipsUntaggedTypes(t *testing.T) {
+	for typ, want := range map[reflect.Type]bool{
+		reflect.TypeFor[[][]validTile]():             false,
+		reflect.TypeFor[map[string]*validTile]():     false,
+		reflect.TypeFor[*validTree]():                true,
+		reflect.TypeFor[[]validStep]():               true,
+		reflect.TypeFor[map[int]interface{}]():       true,
+		reflect.TypeFor[struct{ Next *validTile }](): false,
+	} {
+		if got := hasRules(typ); got != want {
+			t.Errorf("hasRules(%s) = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestValidateTagsCheckedAtRegistration(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a bad validate tag did not panic")
+		}
+	}()
+	HandleDynamic(NewRouter(), incmds.MapGet, func(ctx context.Context, c UserConner, in struct {
+		Flag bool `validate:"min=1"`
+	}) string {
+		return ""
+	})
+}
+
+func TestStrictRouteRejectsUnknownFields(t *testing.T) {
+	b := NewBotConn(-1, &User{Name: "Bot"})
+	replies := b.Subscribe(0, 4)
+	b.Start(t.Context())
+	defer b.Close()
+
+	ran := 0
+	r := NewRouter()
+	h := func(ctx context.Context, c UserConner, in validStep) string {
+		ran++
+		return ""
+	}
+	HandleDynamic(r, incmds.MapGet, h, Strict())
+	HandleDynamic(r, incmds.MapList, h)
+
+	data := []byte(`{"x":1,"y":2}`)
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapGet, Id: 1, Data: data})
+	r.ServeWS(t.Context(), b.UserConn, &RawMessage{Cmd: incmds.MapList, Id: 2, Data: data})
+	for id := uint32(1); id <= 2; id++ {
+		select {
+		case m := <-replies:
+			if failed := m.Error != nil; m.Id != id || failed != (id == 1) {
+				t.Fatalf("reply %d had error %+v", m.Id, m.Error)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no reply to %d", id)
+		}
+	}
+	if ran != 1 {
+		t.Fatalf("handler ran %d times, want once", ran)
+	}
+}